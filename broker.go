@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	"github.com/dfleischhacker/locationhistory-collector/metrics"
+	"github.com/dfleischhacker/locationhistory-collector/owntracks"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// initialRetryDelay is the time to wait before connecting to an MQTT broker again, doubled with each attempt
+	initialRetryDelay = time.Second
+	// maxRetryDelay is the maximum time to wait before connecting to an MQTT broker again
+	maxRetryDelay = time.Minute
+)
+
+// broker is the connection to one of the configured MQTT brokers
+type broker struct {
+	// subscribed is set while the configured topics are subscribed, resubscribe once they have been subscribed
+	// successfully so they are subscribed again after the client reconnected. Both are accessed atomically.
+	subscribed  int32
+	resubscribe int32
+	config      configuration.MqttConfig
+	client      mqtt.Client
+	router      *owntracks.Router
+}
+
+// newBroker creates the client of the MQTT broker described by the given config. Received messages are passed to the
+// given router together with the name of the broker.
+func newBroker(config configuration.MqttConfig, router *owntracks.Router) (*broker, error) {
+	clientOptions, err := newMqttClientOptions(config, router)
+	if err != nil {
+		return nil, err
+	}
+	b := &broker{config: config, router: router}
+	name := config.GetName()
+	metrics.MqttConnected.WithLabelValues(name).Set(0)
+	clientOptions.SetOnConnectHandler(func(mqtt.Client) {
+		metrics.MqttConnected.WithLabelValues(name).Set(1)
+		if atomic.LoadInt32(&b.resubscribe) == 1 {
+			// subscribing blocks until acknowledged by the broker, which must not happen in the handler
+			go b.subscribeAgain()
+		}
+	})
+	clientOptions.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		atomic.StoreInt32(&b.subscribed, 0)
+		metrics.MqttConnected.WithLabelValues(name).Set(0)
+		log.Warnf("Lost connection to MQTT broker '%s': %v", name, err)
+	})
+	b.client = mqtt.NewClient(clientOptions)
+	return b, nil
+}
+
+// check returns an error unless the broker is connected and the configured topics are subscribed
+func (b *broker) check() error {
+	if !b.client.IsConnected() {
+		return fmt.Errorf("not connected")
+	}
+	if atomic.LoadInt32(&b.subscribed) == 0 {
+		return fmt.Errorf("topics not subscribed")
+	}
+	return nil
+}
+
+// connect connects to the MQTT broker and subscribes to the configured topics. Both are retried with exponential
+// backoff until they succeed or the given context is done, so the broker does not have to be available at startup.
+func (b *broker) connect(ctx context.Context) error {
+	delay := initialRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := b.subscribe()
+		if err == nil {
+			atomic.StoreInt32(&b.resubscribe, 1)
+			log.Infof("Subscribed successfully to MQTT broker '%s'", b.config.GetName())
+			return nil
+		}
+		log.Errorf("Unable to connect to MQTT broker '%s' (attempt %d), retrying in %s: %v", b.config.GetName(),
+			attempt, delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// subscribe connects to the MQTT broker unless already connected and subscribes to the configured topics
+func (b *broker) subscribe() error {
+	if !b.client.IsConnected() {
+		token := b.client.Connect()
+		if token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+		log.Debugf("Connected to MQTT broker '%s'", b.config.GetName())
+	}
+
+	token := b.client.SubscribeMultiple(b.config.Filters(), messageHandler(b.config.GetName(), b.router))
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("unable to subscribe: %v", token.Error())
+	}
+	atomic.StoreInt32(&b.subscribed, 1)
+	return nil
+}
+
+// subscribeAgain subscribes to the configured topics after the client reconnected, as the broker does not keep the
+// subscriptions of clean sessions
+func (b *broker) subscribeAgain() {
+	err := b.subscribe()
+	if err != nil {
+		log.Errorf("Unable to subscribe to MQTT broker '%s' after reconnecting: %v", b.config.GetName(), err)
+		return
+	}
+	log.Infof("Subscribed again to MQTT broker '%s'", b.config.GetName())
+}
+
+// disconnect stops receiving messages and disconnects from the MQTT broker. Persistent sessions keep their
+// subscriptions, so the broker queues messages until the collector connects again.
+func (b *broker) disconnect() {
+	log.Infof("Disconnecting from MQTT broker '%s'", b.config.GetName())
+	if !b.config.PersistentSession {
+		b.unsubscribe()
+	}
+	// give the handlers of messages already received some time to finish
+	b.client.Disconnect(250)
+	atomic.StoreInt32(&b.subscribed, 0)
+	metrics.MqttConnected.WithLabelValues(b.config.GetName()).Set(0)
+}
+
+// unsubscribe removes the subscriptions of all configured topic filters
+func (b *broker) unsubscribe() {
+	filters := make([]string, 0, len(b.config.Filters()))
+	for filter := range b.config.Filters() {
+		filters = append(filters, filter)
+	}
+	token := b.client.Unsubscribe(filters...)
+	if !token.WaitTimeout(shutdownTimeout) {
+		log.Warnf("Timeout while unsubscribing from MQTT broker '%s'", b.config.GetName())
+	} else if token.Error() != nil {
+		log.Warnf("Unable to unsubscribe from MQTT broker '%s': %v", b.config.GetName(), token.Error())
+	}
+}
+
+// newMqttClientOptions returns the options of the MQTT client for the given config. Messages are passed to the given
+// router.
+func newMqttClientOptions(config configuration.MqttConfig, router *owntracks.Router) (*mqtt.ClientOptions, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	clientOptions := mqtt.NewClientOptions().AddBroker(config.BrokerURL())
+	clientOptions.SetPingTimeout(config.PingTimeout())
+	clientOptions.SetAutoReconnect(true)
+	clientOptions.SetCleanSession(!config.PersistentSession)
+	clientOptions.SetKeepAlive(config.KeepAlive())
+	clientOptions.SetConnectTimeout(10 * time.Second)
+	if config.ClientID != "" {
+		clientOptions.SetClientID(config.ClientID)
+	}
+	if config.PersistentSession {
+		// messages queued by the broker are delivered before subscribing again
+		clientOptions.SetResumeSubs(true)
+		clientOptions.SetDefaultPublishHandler(messageHandler(config.GetName(), router))
+	}
+
+	if config.Username != "" {
+		clientOptions.SetUsername(config.Username)
+	}
+	if config.Password != "" {
+		clientOptions.SetPassword(config.Password)
+	}
+
+	tlsConfig, err := NewTLSConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up TLS: %v", err)
+	}
+	clientOptions.SetTLSConfig(tlsConfig)
+	return clientOptions, nil
+}
+
+// NewTLSConfig sets up a TLS configuration for connecting to the broker. The system certificates are trusted in
+// addition to those of the configured CA file.
+func NewTLSConfig(config configuration.MqttConfig) (*tls.Config, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		log.Warnf("Unable to get system certificates: %v", err)
+		rootCAs = x509.NewCertPool()
+	}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs:            rootCAs,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.InsecureSkipVerify {
+		log.Warn("Certificate of the MQTT broker is not verified")
+	}
+	if config.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// messageHandler returns the handler passing messages received from the named broker to the given router
+func messageHandler(source string, router *owntracks.Router) mqtt.MessageHandler {
+	return func(client mqtt.Client, message mqtt.Message) {
+		log.Debugf("Got message from '%s' on topic '%s': %s\n", source, message.Topic(), message.Payload())
+		err := router.HandleMessage(source, message.Topic(), message.Payload())
+		if err != nil {
+			log.Warnf("Unable to handle message on topic '%s': %v", message.Topic(), err)
+		}
+	}
+}
@@ -1,36 +1,245 @@
 package configuration
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/pelletier/go-toml"
 	log "github.com/sirupsen/logrus"
 )
 
-// The MqttConfig defines the MQTT server used to retrieve location data
+// The MqttConfig defines an MQTT broker used to retrieve location data
 type MqttConfig struct {
+	// Name identifies the broker and is stored as source of the received waypoints, defaults to the URL
+	Name string
 	// URL to connect to MQTT broker
 	URL string
-	// Topic to listen for location updates
+	// Topic to listen for location updates, subscribed in addition to Topics
 	Topic string
+	// Topics are further topic filters to subscribe to
+	Topics []TopicFilter
 	// Username to use when connecting
 	Username string
 	// Password for the user
 	Password string
+	// SecretKey used to decrypt OwnTracks payloads encrypted end-to-end
+	SecretKey string
+	// SecretKeys maps device topics to the secret key used by that device, overriding SecretKey
+	SecretKeys map[string]string
+	// ClientID identifies the collector at the broker, a random ID is used if empty
+	ClientID string
+	// PersistentSession keeps the session at the broker while the collector is disconnected so messages are queued
+	// instead of being lost, requires a ClientID
+	PersistentSession bool
+	// QoS used to subscribe to topic filters without their own QoS, defaults to 1
+	QoS *int
+	// KeepAliveSeconds is the interval of keepalive pings sent to the broker, defaults to 10 seconds
+	KeepAliveSeconds int
+	// PingTimeoutSeconds is the time to wait for the response to a ping, defaults to 10 seconds
+	PingTimeoutSeconds int
+	// Transport used if the URL does not contain a scheme, one of tcp, tls, ws and wss, defaults to tcp
+	Transport string
+	// CAFile contains additional PEM encoded certificates trusted when connecting via TLS
+	CAFile string
+	// CertFile and KeyFile contain the PEM encoded client certificate and key for authenticating via TLS
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables the verification of the broker certificate, only use it for testing
+	InsecureSkipVerify bool
+}
+
+// TopicFilter is a topic filter subscribed at a broker
+type TopicFilter struct {
+	// Filter is the topic filter which may contain wildcards
+	Filter string
+	// QoS used to subscribe to the filter, defaults to the QoS of the broker
+	QoS *int
+}
+
+// mqttSchemes maps the supported transports to the URL scheme used by the MQTT client
+var mqttSchemes = map[string]string{
+	"tcp": "tcp",
+	"tls": "ssl",
+	"ws":  "ws",
+	"wss": "wss",
+}
+
+// Validate checks the MQTT configuration for invalid or inconsistent values
+func (config MqttConfig) Validate() error {
+	if qos := config.GetQoS(); qos < 0 || qos > 2 {
+		return fmt.Errorf("invalid MQTT QoS %d, use 0, 1 or 2", qos)
+	}
+	if config.Topic == "" && len(config.Topics) == 0 {
+		return fmt.Errorf("no topic to subscribe to at MQTT broker %s", config.GetName())
+	}
+	for _, topic := range config.Topics {
+		if topic.Filter == "" {
+			return fmt.Errorf("empty topic filter for MQTT broker %s", config.GetName())
+		}
+		if topic.QoS != nil && (*topic.QoS < 0 || *topic.QoS > 2) {
+			return fmt.Errorf("invalid MQTT QoS %d for topic filter %s, use 0, 1 or 2", *topic.QoS, topic.Filter)
+		}
+	}
+	if _, ok := mqttSchemes[config.GetTransport()]; !ok {
+		return fmt.Errorf("invalid MQTT transport '%s', use tcp, tls, ws or wss", config.Transport)
+	}
+	if config.PersistentSession && config.ClientID == "" {
+		return fmt.Errorf("a persistent MQTT session requires a ClientID")
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("both CertFile and KeyFile are required for MQTT client certificates")
+	}
+	return nil
+}
+
+// GetName returns the name identifying the broker
+func (config MqttConfig) GetName() string {
+	if config.Name == "" {
+		return config.URL
+	}
+	return config.Name
+}
+
+// Filters returns all topic filters to subscribe to together with their QoS
+func (config MqttConfig) Filters() map[string]byte {
+	filters := make(map[string]byte)
+	if config.Topic != "" {
+		filters[config.Topic] = byte(config.GetQoS())
+	}
+	for _, topic := range config.Topics {
+		qos := config.GetQoS()
+		if topic.QoS != nil {
+			qos = *topic.QoS
+		}
+		filters[topic.Filter] = byte(qos)
+	}
+	return filters
+}
+
+// GetQoS returns the QoS used to subscribe to topic filters without their own QoS
+func (config MqttConfig) GetQoS() int {
+	if config.QoS == nil {
+		return 1
+	}
+	return *config.QoS
+}
+
+// KeepAlive returns the interval of keepalive pings
+func (config MqttConfig) KeepAlive() time.Duration {
+	if config.KeepAliveSeconds <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(config.KeepAliveSeconds) * time.Second
+}
+
+// PingTimeout returns the time to wait for the response to a ping
+func (config MqttConfig) PingTimeout() time.Duration {
+	if config.PingTimeoutSeconds <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(config.PingTimeoutSeconds) * time.Second
+}
+
+// GetTransport returns the transport used if the URL does not contain a scheme
+func (config MqttConfig) GetTransport() string {
+	if config.Transport == "" {
+		return "tcp"
+	}
+	return strings.ToLower(config.Transport)
+}
+
+// BrokerURL returns the URL of the broker including the scheme of the configured transport
+func (config MqttConfig) BrokerURL() string {
+	if strings.Contains(config.URL, "://") {
+		return config.URL
+	}
+	return mqttSchemes[config.GetTransport()] + "://" + config.URL
+}
+
+// SecretKeyForTopic returns the secret key used to decrypt payloads received for the given device topic or an empty
+// string if no key is configured
+func (config MqttConfig) SecretKeyForTopic(topic string) string {
+	if key, ok := config.SecretKeys[topic]; ok {
+		return key
+	}
+	return config.SecretKey
+}
+
+// SecretKeyForTopic returns the secret key for messages of the given device topic received from the given source.
+// Messages received from other sources than a broker, e.g. via HTTP, use the key configured for the topic at any
+// broker or the first default key.
+func (config *Configuration) SecretKeyForTopic(source string, topic string) string {
+	for _, broker := range config.Mqtt {
+		if broker.GetName() == source {
+			return broker.SecretKeyForTopic(topic)
+		}
+	}
+	for _, broker := range config.Mqtt {
+		if key, ok := broker.SecretKeys[topic]; ok {
+			return key
+		}
+	}
+	for _, broker := range config.Mqtt {
+		if broker.SecretKey != "" {
+			return broker.SecretKey
+		}
+	}
+	return ""
 }
 
 // The DatabaseConfig defines the database used to store location data
 type DatabaseConfig struct {
-	// dsn to connect to database
+	// DriverName of the database, either sqlite3 or postgres
 	DriverName string
-	Dsn        string
+	// dsn to connect to database
+	Dsn string
+	// PostGIS enables a geography column with spatial index when using PostgreSQL
+	PostGIS bool
+	// BatchSize is the maximum number of waypoints written in a single transaction, defaults to 100
+	BatchSize int
+	// FlushIntervalMillis is the maximum time waypoints are buffered before being written, defaults to one second
+	FlushIntervalMillis int
+	// QueueSize is the number of waypoints buffered before receiving further waypoints blocks, defaults to 1000
+	QueueSize int
+}
+
+// GetBatchSize returns the maximum number of waypoints written in a single transaction
+func (config DatabaseConfig) GetBatchSize() int {
+	if config.BatchSize <= 0 {
+		return 100
+	}
+	return config.BatchSize
+}
+
+// FlushInterval returns the maximum time waypoints are buffered before being written
+func (config DatabaseConfig) FlushInterval() time.Duration {
+	if config.FlushIntervalMillis <= 0 {
+		return time.Second
+	}
+	return time.Duration(config.FlushIntervalMillis) * time.Millisecond
+}
+
+// GetQueueSize returns the number of waypoints buffered before receiving further waypoints blocks
+func (config DatabaseConfig) GetQueueSize() int {
+	if config.QueueSize <= 0 {
+		return 1000
+	}
+	return config.QueueSize
 }
 
 // The Configuration of the locationhistory app
 type Configuration struct {
-	Mqtt     MqttConfig
-	Database DatabaseConfig
-	Map      MapConfig
+	Mqtt       []MqttConfig
+	Database   DatabaseConfig
+	Map        MapConfig
+	Validation ValidationConfig
+	Ingest     IngestConfig
+	Health     HealthConfig
+	Auth       AuthConfig
 }
 
 // The MapConfig used for showing the waypoint map on the web UI
@@ -38,20 +247,259 @@ type MapConfig struct {
 	Token       string
 	BindAddress string
 	Port        int
+	// CertFile and KeyFile contain the PEM encoded certificate and key of the web server, setting them enables HTTPS.
+	// Both files are loaded again when they change.
+	CertFile string
+	KeyFile  string
+	// MinTLSVersion is the minimum TLS version accepted by the web server, either 1.2 or 1.3, defaults to 1.2
+	MinTLSVersion string
+	// ClientCAFile contains PEM encoded CA certificates. If set, clients may authenticate with a certificate signed by
+	// one of them and authentication is required.
+	ClientCAFile string
+	// RedirectPort is the port of a plain HTTP server redirecting all requests to HTTPS, 0 disables the redirect
+	RedirectPort int
+}
+
+// TLSEnabled returns true if the web server uses HTTPS
+func (config MapConfig) TLSEnabled() bool {
+	return config.CertFile != ""
+}
+
+// Validate checks the web server configuration for invalid or inconsistent values
+func (config MapConfig) Validate() error {
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return fmt.Errorf("both CertFile and KeyFile are required for HTTPS")
+	}
+	if !config.TLSEnabled() && (config.ClientCAFile != "" || config.RedirectPort != 0) {
+		return fmt.Errorf("ClientCAFile and RedirectPort require CertFile and KeyFile")
+	}
+	_, err := config.GetMinTLSVersion()
+	return err
+}
+
+// GetMinTLSVersion returns the minimum TLS version accepted by the web server
+func (config MapConfig) GetMinTLSVersion() (uint16, error) {
+	switch config.MinTLSVersion {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported minimum TLS version '%s', use 1.2 or 1.3", config.MinTLSVersion)
+}
+
+// The IngestConfig defines the HTTP endpoints of the web server which accept location data directly from devices
+type IngestConfig struct {
+	// OwnTracks enables the endpoint for OwnTracks clients in HTTP mode
+	OwnTracks bool
+	// OwnTracksPath is the path of the OwnTracks endpoint, defaults to /pub
+	OwnTracksPath string
+	// TopicPrefix is prepended to user and device name to build the topic for data received via HTTP, defaults to
+	// owntracks
+	TopicPrefix string
+	// Endpoints accepting data from other tracking clients
+	Endpoints []IngestEndpointConfig
+}
+
+// The IngestEndpointConfig defines an HTTP endpoint accepting location data from a tracking client
+type IngestEndpointConfig struct {
+	// Protocol spoken by the client, one of gpslogger, overland or osmand
+	Protocol string
+	// Path of the endpoint
+	Path string
+	// Topic used for all devices not listed in Devices. If empty, the topic is built from the topic prefix, the
+	// protocol and the device ID sent by the client.
+	Topic string
+	// Devices maps the device IDs sent by clients to topics
+	Devices map[string]string
+}
+
+// TopicForDevice returns the topic for data of the device with the given ID or an empty string if no topic can be
+// determined
+func (config IngestEndpointConfig) TopicForDevice(prefix string, device string) string {
+	if topic, ok := config.Devices[device]; ok {
+		return topic
+	}
+	if config.Topic != "" {
+		return config.Topic
+	}
+	if device == "" {
+		return ""
+	}
+	return prefix + "/" + config.Protocol + "/" + device
+}
+
+// GetOwnTracksPath returns the path of the OwnTracks endpoint
+func (config IngestConfig) GetOwnTracksPath() string {
+	if config.OwnTracksPath == "" {
+		return "/pub"
+	}
+	return config.OwnTracksPath
+}
+
+// GetTopicPrefix returns the prefix of the topics for data received via HTTP
+func (config IngestConfig) GetTopicPrefix() string {
+	if config.TopicPrefix == "" {
+		return "owntracks"
+	}
+	return config.TopicPrefix
+}
+
+// The ValidationConfig defines which location messages are accepted. Rejected messages are kept as dead letters.
+type ValidationConfig struct {
+	// MaxFutureSeconds is the number of seconds a timestamp may lie in the future, defaults to one hour and a negative
+	// value disables the check
+	MaxFutureSeconds int
+	// MaxAgeDays is the number of days a timestamp may lie in the past, 0 disables the check
+	MaxAgeDays int
+	// AllowNullIsland accepts positions at exactly latitude and longitude 0
+	AllowNullIsland bool
+}
+
+// MaxFuture returns the duration a timestamp may lie in the future or 0 if timestamps in the future are not checked
+func (config ValidationConfig) MaxFuture() time.Duration {
+	if config.MaxFutureSeconds < 0 {
+		return 0
+	}
+	if config.MaxFutureSeconds == 0 {
+		return time.Hour
+	}
+	return time.Duration(config.MaxFutureSeconds) * time.Second
+}
+
+// MaxAge returns the duration a timestamp may lie in the past or 0 if the age of timestamps is not checked
+func (config ValidationConfig) MaxAge() time.Duration {
+	if config.MaxAgeDays <= 0 {
+		return 0
+	}
+	return time.Duration(config.MaxAgeDays) * 24 * time.Hour
+}
+
+// The AuthConfig defines how users of the web server are authenticated and which topics they may read. Without any
+// users, tokens, trusted header or client certificates, authentication is disabled and all topics may be read by
+// anyone.
+type AuthConfig struct {
+	// Users maps user names to the bcrypt hashes of their passwords used for basic auth
+	Users map[string]string
+	// Tokens maps API tokens sent as bearer tokens to the name of the user they authenticate
+	Tokens map[string]string
+	// TrustedHeader is the name of a header containing the user authenticated by a reverse proxy. The proxy has to
+	// remove the header from client requests.
+	TrustedHeader string
+	// TrustedProxies lists the addresses or networks in CIDR notation of the reverse proxies which may set the
+	// TrustedHeader, it is ignored in requests from all other addresses
+	TrustedProxies []string
+	// ACL maps user names to the topic filters they may read, which may contain the MQTT wildcards + and #. Users
+	// without an entry may not read any topic.
+	ACL map[string][]string
+	// WriteACL maps user names to the topic filters they may send data for to the ingest endpoints. Users without an
+	// entry may not send data for any topic. OwnTracks clients in HTTP mode always publish to the topic of their user.
+	WriteACL map[string][]string
+}
+
+// Enabled returns true if any way to authenticate users is configured
+func (config AuthConfig) Enabled() bool {
+	return len(config.Users) > 0 || len(config.Tokens) > 0 || config.TrustedHeader != ""
+}
+
+// AuthEnabled returns true if users of the web server have to authenticate, either by any of the ways configured in
+// the AuthConfig or by a client certificate
+func (config *Configuration) AuthEnabled() bool {
+	return config.Auth.Enabled() || config.Map.ClientCAFile != ""
+}
+
+// Validate checks the authentication configuration for invalid or inconsistent values
+func (config AuthConfig) Validate() error {
+	if config.TrustedHeader != "" && len(config.TrustedProxies) == 0 {
+		return fmt.Errorf("TrustedHeader requires the addresses of the TrustedProxies")
+	}
+	_, err := config.TrustedProxyNetworks()
+	return err
+}
+
+// TrustedProxyNetworks returns the networks of the trusted proxies. Single addresses are returned as networks
+// containing only that address.
+func (config AuthConfig) TrustedProxyNetworks() ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(config.TrustedProxies))
+	for _, proxy := range config.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address of trusted proxy '%s'", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network of trusted proxies '%s'", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// The HealthConfig defines when the collector is reported as ready by the readiness endpoint
+type HealthConfig struct {
+	// MaxMessageAgeMinutes is the time in minutes since the last message received from an MQTT broker after which the
+	// collector is not ready anymore, 0 disables the check. It also applies to topics in Topics without their own
+	// maximum age.
+	MaxMessageAgeMinutes int
+	// Topics maps topics to their maximum message age in minutes. Only topics listed here are checked, even if no
+	// message has been received for them since the collector was started.
+	Topics map[string]int
+}
+
+// MaxBrokerMessageAge returns the time since the last message received from an MQTT broker after which the collector
+// is not ready or 0 if the age of messages received from brokers is not checked
+func (config HealthConfig) MaxBrokerMessageAge() time.Duration {
+	if config.MaxMessageAgeMinutes <= 0 {
+		return 0
+	}
+	return time.Duration(config.MaxMessageAgeMinutes) * time.Minute
+}
+
+// MaxMessageAge returns the time since the last message of the given topic after which the collector is not ready or
+// 0 if the age of messages of the topic is not checked
+func (config HealthConfig) MaxMessageAge(topic string) time.Duration {
+	minutes, ok := config.Topics[topic]
+	if !ok {
+		return 0
+	}
+	if minutes <= 0 {
+		return config.MaxBrokerMessageAge()
+	}
+	return time.Duration(minutes) * time.Minute
 }
 
 // LoadConfiguration loads a config file from the given path and returns the resulting Configuration
-func LoadConfiguration(path string) *Configuration {
-	log.Debugln("Trying to load data from path {}", path)
+func LoadConfiguration(path string) (*Configuration, error) {
+	log.Debugf("Trying to load data from path %s", path)
 
 	fileContent, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
+	tree, err := toml.LoadBytes(fileContent)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("invalid configuration file %s: %v", path, err)
+	}
+	// a single [Mqtt] table was used before multiple brokers were supported
+	if broker, ok := tree.Get("Mqtt").(*toml.Tree); ok {
+		tree.Set("Mqtt", []*toml.Tree{broker})
 	}
 
 	config := Configuration{}
-	toml.Unmarshal(fileContent, &config)
+	err = tree.Unmarshal(&config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %v", path, err)
+	}
 
-	return &config
+	return &config, nil
 }
@@ -0,0 +1,97 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"strconv"
+	"strings"
+	"time"
+
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+var csvHeader = []string{"id", "topic", "time", "latitude", "longitude", "accuracy", "altitude", "vertical_accuracy",
+	"velocity", "course", "battery", "battery_state", "pressure", "trigger", "connectivity", "tracker_id", "ssid",
+	"bssid", "in_regions", "source"}
+
+// csvWriter writes waypoints as comma separated values with a header row. Missing values are left empty.
+type csvWriter struct {
+	out           *bufio.Writer
+	csv           *csv.Writer
+	headerWritten bool
+}
+
+func newCSVWriter(out *bufio.Writer) Writer {
+	return &csvWriter{out: out, csv: csv.NewWriter(out)}
+}
+
+func (w *csvWriter) writeHeader() error {
+	if w.headerWritten {
+		return nil
+	}
+	w.headerWritten = true
+	return w.csv.Write(csvHeader)
+}
+
+func (w *csvWriter) Write(wp locationhistory.Waypoint) error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+	return w.csv.Write([]string{
+		strconv.Itoa(wp.ID),
+		wp.Topic,
+		wp.Datetime.Format(time.RFC3339),
+		strconv.FormatFloat(wp.Latitude, 'f', -1, 64),
+		strconv.FormatFloat(wp.Longitude, 'f', -1, 64),
+		intValue(wp.Accuracy),
+		intValue(wp.Altitude),
+		intValue(wp.VerticalAccuracy),
+		intValue(wp.Velocity),
+		intValue(wp.Course),
+		intValue(wp.Battery),
+		intValue(wp.BatteryState),
+		floatValue(wp.Pressure),
+		stringValue(wp.Trigger),
+		stringValue(wp.Connectivity),
+		stringValue(wp.TrackerID),
+		stringValue(wp.SSID),
+		stringValue(wp.BSSID),
+		strings.Join(wp.InRegions, ";"),
+		stringValue(wp.Source),
+	})
+}
+
+func (w *csvWriter) Close() error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+	w.csv.Flush()
+	err = w.csv.Error()
+	if err != nil {
+		return err
+	}
+	return w.out.Flush()
+}
+
+func intValue(i *int) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.Itoa(*i)
+}
+
+func floatValue(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f, 'f', -1, 64)
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,42 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+// Writer writes waypoints one by one in a specific format, so exports do not need to be kept in memory
+type Writer interface {
+	// Write appends the given waypoint to the output
+	Write(waypoint locationhistory.Waypoint) error
+	// Close completes the output. It does not close the underlying io.Writer.
+	Close() error
+}
+
+// newWriterFuncs contains the constructors of all supported formats
+var newWriterFuncs = map[string]func(out *bufio.Writer) Writer{
+	"json":    newJSONWriter,
+	"jsonl":   newJSONLinesWriter,
+	"geojson": newGeoJSONWriter,
+	"gpx":     newGpxWriter,
+	"csv":     newCSVWriter,
+	"kml":     newKMLWriter,
+}
+
+// Formats returns the names of all supported formats
+func Formats() []string {
+	return []string{"json", "jsonl", "geojson", "gpx", "csv", "kml"}
+}
+
+// NewWriter returns a writer for the given format writing to out
+func NewWriter(format string, out io.Writer) (Writer, error) {
+	newWriter, ok := newWriterFuncs[strings.ToLower(format)]
+	if !ok {
+		return nil, fmt.Errorf("unknown format '%s', supported formats are %s", format, strings.Join(Formats(), ", "))
+	}
+	return newWriter(bufio.NewWriter(out)), nil
+}
@@ -0,0 +1,74 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+// Feature is a GeoJSON feature representing a single waypoint
+type Feature struct {
+	Type       string                   `json:"type"`
+	Geometry   Geometry                 `json:"geometry"`
+	Properties locationhistory.Waypoint `json:"properties"`
+}
+
+// Geometry is a GeoJSON point
+type Geometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// NewFeature creates a GeoJSON feature for the given waypoint. All data of the waypoint is kept in the properties.
+func NewFeature(waypoint locationhistory.Waypoint) Feature {
+	// GeoJSON positions are longitude first
+	coordinates := []float64{waypoint.Longitude, waypoint.Latitude}
+	if waypoint.Altitude != nil {
+		coordinates = append(coordinates, float64(*waypoint.Altitude))
+	}
+	return Feature{
+		Type:       "Feature",
+		Geometry:   Geometry{Type: "Point", Coordinates: coordinates},
+		Properties: waypoint,
+	}
+}
+
+// geoJSONWriter writes all waypoints as a GeoJSON feature collection
+type geoJSONWriter struct {
+	out   *bufio.Writer
+	count int
+}
+
+func newGeoJSONWriter(out *bufio.Writer) Writer {
+	return &geoJSONWriter{out: out}
+}
+
+func (w *geoJSONWriter) Write(waypoint locationhistory.Waypoint) error {
+	data, err := json.Marshal(NewFeature(waypoint))
+	if err != nil {
+		return err
+	}
+	separator := ",\n "
+	if w.count == 0 {
+		separator = `{"type":"FeatureCollection","features":[` + "\n "
+	}
+	w.count++
+	_, err = w.out.WriteString(separator)
+	if err == nil {
+		_, err = w.out.Write(data)
+	}
+	return err
+}
+
+func (w *geoJSONWriter) Close() error {
+	end := "\n]}\n"
+	if w.count == 0 {
+		end = `{"type":"FeatureCollection","features":[]}` + "\n"
+	}
+	_, err := w.out.WriteString(end)
+	if err != nil {
+		return err
+	}
+	return w.out.Flush()
+}
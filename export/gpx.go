@@ -0,0 +1,83 @@
+package export
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+const gpxHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="lohico" xmlns="http://www.topografix.com/GPX/1/1">
+`
+
+// gpxWriter writes waypoints as GPX 1.1 document with one track per topic. The document is written directly instead
+// of using gpxgo as that keeps the whole document in memory.
+type gpxWriter struct {
+	out   *bufio.Writer
+	topic *string
+}
+
+func newGpxWriter(out *bufio.Writer) Writer {
+	return &gpxWriter{out: out}
+}
+
+func (w *gpxWriter) Write(waypoint locationhistory.Waypoint) error {
+	if w.topic == nil {
+		_, err := w.out.WriteString(gpxHeader)
+		if err != nil {
+			return err
+		}
+	}
+	if w.topic == nil || *w.topic != waypoint.Topic {
+		if w.topic != nil {
+			_, err := w.out.WriteString("  </trkseg></trk>\n")
+			if err != nil {
+				return err
+			}
+		}
+		topic := waypoint.Topic
+		w.topic = &topic
+		_, err := w.out.WriteString("  <trk><name>")
+		if err == nil {
+			err = xml.EscapeText(w.out, []byte(topic))
+		}
+		if err == nil {
+			_, err = w.out.WriteString("</name><trkseg>\n")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w.out, `    <trkpt lat="%f" lon="%f">`, waypoint.Latitude, waypoint.Longitude)
+	if err != nil {
+		return err
+	}
+	if waypoint.Altitude != nil {
+		_, err = fmt.Fprintf(w.out, "<ele>%d</ele>", *waypoint.Altitude)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w.out, "<time>%s</time></trkpt>\n", waypoint.Datetime.UTC().Format(time.RFC3339))
+	return err
+}
+
+func (w *gpxWriter) Close() error {
+	var err error
+	if w.topic == nil {
+		_, err = w.out.WriteString(gpxHeader)
+	} else {
+		_, err = w.out.WriteString("  </trkseg></trk>\n")
+	}
+	if err == nil {
+		_, err = w.out.WriteString("</gpx>\n")
+	}
+	if err != nil {
+		return err
+	}
+	return w.out.Flush()
+}
@@ -0,0 +1,65 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+// jsonWriter writes all waypoints as a single JSON array
+type jsonWriter struct {
+	out   *bufio.Writer
+	count int
+}
+
+func newJSONWriter(out *bufio.Writer) Writer {
+	return &jsonWriter{out: out}
+}
+
+func (w *jsonWriter) Write(waypoint locationhistory.Waypoint) error {
+	data, err := json.Marshal(waypoint)
+	if err != nil {
+		return err
+	}
+	separator := ",\n "
+	if w.count == 0 {
+		separator = "[\n "
+	}
+	w.count++
+	_, err = w.out.WriteString(separator)
+	if err == nil {
+		_, err = w.out.Write(data)
+	}
+	return err
+}
+
+func (w *jsonWriter) Close() error {
+	end := "\n]\n"
+	if w.count == 0 {
+		end = "[]\n"
+	}
+	_, err := w.out.WriteString(end)
+	if err != nil {
+		return err
+	}
+	return w.out.Flush()
+}
+
+// jsonLinesWriter writes each waypoint as JSON object on its own line
+type jsonLinesWriter struct {
+	out     *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newJSONLinesWriter(out *bufio.Writer) Writer {
+	return &jsonLinesWriter{out: out, encoder: json.NewEncoder(out)}
+}
+
+func (w *jsonLinesWriter) Write(waypoint locationhistory.Waypoint) error {
+	return w.encoder.Encode(waypoint)
+}
+
+func (w *jsonLinesWriter) Close() error {
+	return w.out.Flush()
+}
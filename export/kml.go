@@ -0,0 +1,78 @@
+package export
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+const kmlHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2"><Document>
+`
+
+// kmlWriter writes waypoints as KML document containing a folder per topic with a timestamped placemark per waypoint
+type kmlWriter struct {
+	out   *bufio.Writer
+	topic *string
+}
+
+func newKMLWriter(out *bufio.Writer) Writer {
+	return &kmlWriter{out: out}
+}
+
+func (w *kmlWriter) Write(waypoint locationhistory.Waypoint) error {
+	if w.topic == nil {
+		_, err := w.out.WriteString(kmlHeader)
+		if err != nil {
+			return err
+		}
+	}
+	if w.topic == nil || *w.topic != waypoint.Topic {
+		if w.topic != nil {
+			_, err := w.out.WriteString("  </Folder>\n")
+			if err != nil {
+				return err
+			}
+		}
+		topic := waypoint.Topic
+		w.topic = &topic
+		_, err := w.out.WriteString("  <Folder><name>")
+		if err == nil {
+			err = xml.EscapeText(w.out, []byte(topic))
+		}
+		if err == nil {
+			_, err = w.out.WriteString("</name>\n")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	altitude := 0
+	if waypoint.Altitude != nil {
+		altitude = *waypoint.Altitude
+	}
+	// KML coordinates are longitude first
+	_, err := fmt.Fprintf(w.out, "    <Placemark><TimeStamp><when>%s</when></TimeStamp><Point><coordinates>%f,%f,%d</coordinates></Point></Placemark>\n",
+		waypoint.Datetime.UTC().Format(time.RFC3339), waypoint.Longitude, waypoint.Latitude, altitude)
+	return err
+}
+
+func (w *kmlWriter) Close() error {
+	var err error
+	if w.topic == nil {
+		_, err = w.out.WriteString(kmlHeader)
+	} else {
+		_, err = w.out.WriteString("  </Folder>\n")
+	}
+	if err == nil {
+		_, err = w.out.WriteString("</Document></kml>\n")
+	}
+	if err != nil {
+		return err
+	}
+	return w.out.Flush()
+}
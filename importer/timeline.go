@@ -1,77 +1,115 @@
 package importer
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
 	"github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/metrics"
 	"github.com/dfleischhacker/locationhistory-collector/utils"
 	log "github.com/sirupsen/logrus"
-	"os"
 )
 
 // ImportTimeline reads the exported Google Timeline data from the given `fileName` and imports it into the
 // provided `database`. The return value is the number of imported waypoints or, if an error occurs, the error.
-// The data is returned for the given `topic`.
-func ImportTimeline(database *locationhistory.LocationDatabase, fileName string, topic string) (int, error) {
+// The data is returned for the given `topic`. Records which cannot be imported are reported with their position in
+// the file and skipped, only malformed JSON aborts the import.
+func ImportTimeline(database locationhistory.Store, fileName string, topic string) (int, error) {
 	var count = 0
+	began := time.Now()
 	stream, err := os.Open(fileName)
 	if err != nil {
 		return 0, err
 	}
 	defer stream.Close()
 	dec := json.NewDecoder(stream)
-
-	rTx, err := database.OpenTransaction()
+	lines, err := newLineCounter(fileName)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
+	defer lines.Close()
 
 	// read open curly brace, the locations key and the opening bracket
-	_, err = dec.Token()
+	for _, expected := range []interface{}{json.Delim('{'), "locations", json.Delim('[')} {
+		token, err := dec.Token()
+		if err != nil {
+			return 0, lines.errorAt(dec.InputOffset(), err)
+		}
+		if token != expected {
+			return 0, lines.errorAt(dec.InputOffset(), fmt.Errorf("expected %v but got %v", expected, token))
+		}
+	}
+
+	rTx, err := database.OpenTransaction()
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	dec.More()
-	_, err = dec.Token()
-	dec.More()
-	_, err = dec.Token()
 
+	skipped := 0
 	for dec.More() {
+		offset := dec.InputOffset()
 		var twp timelineWaypoint
 		// decode an array value (Message)
 		err := dec.Decode(&twp)
+		if _, invalidValue := err.(*json.UnmarshalTypeError); err != nil && !invalidValue {
+			rTx.Rollback()
+			return 0, lines.errorAt(dec.InputOffset(), err)
+		}
+		var waypoint locationhistory.Waypoint
+		if err == nil {
+			waypoint, err = twp.toWaypoint(topic)
+		}
 		if err != nil {
-			log.Fatal(err)
+			// the decoder skips the whole record, so the import continues with the next one
+			skipped++
+			log.Warnf("Skipping record %d: %v", count+skipped, lines.errorAt(offset, err))
+			continue
 		}
 
+		err = rTx.AddWaypoint(waypoint)
+		if err != nil {
+			rTx.Rollback()
+			return 0, lines.errorAt(offset, err)
+		}
 		count += 1
-		rTx.AddWaypoint(twp.toWaypoint(topic))
 	}
 
 	// read closing bracket
 	_, err = dec.Token()
 	if err != nil {
-		log.Fatal(err)
+		rTx.Rollback()
+		return 0, lines.errorAt(dec.InputOffset(), err)
 	}
 
 	err = rTx.Commit()
 	if err != nil {
 		return 0, err
 	}
+	metrics.WaypointsImported.WithLabelValues("timeline").Add(float64(count))
+	metrics.ImportDuration.WithLabelValues("timeline").Set(time.Since(began).Seconds())
+	metrics.LastImport.WithLabelValues("timeline").SetToCurrentTime()
+	if skipped > 0 {
+		log.Warnf("Skipped %d invalid records", skipped)
+	}
 
 	return count, nil
 }
 
-func (twp *timelineWaypoint) toWaypoint(topic string) locationhistory.Waypoint {
+func (twp *timelineWaypoint) toWaypoint(topic string) (locationhistory.Waypoint, error) {
 	datetime, err := utils.GetUnixTime(twp.TimestampMs, 1000)
 	if err != nil {
-		log.Fatal(err)
+		return locationhistory.Waypoint{}, fmt.Errorf("invalid timestamp '%s': %v", twp.TimestampMs, err)
 	}
 	return locationhistory.Waypoint{
 		Topic:     topic,
 		Datetime:  datetime.Time,
 		Longitude: float64(twp.Longitude) / 10000000,
 		Latitude:  float64(twp.Latitude) / 10000000,
-	}
+	}, nil
 }
 
 type timelineWaypoint struct {
@@ -83,3 +121,42 @@ type timelineWaypoint struct {
 	Altitude         int    `json:"altitude"`
 	VerticalAccuracy int    `json:"verticalAccuracy"`
 }
+
+// lineCounter determines the line of offsets in a file. It reads the file a second time, so it does not interfere
+// with the decoder and works for files of any size as long as offsets are requested in ascending order.
+type lineCounter struct {
+	file   *os.File
+	reader *bufio.Reader
+	offset int64
+	line   int
+}
+
+func newLineCounter(fileName string) (*lineCounter, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &lineCounter{file: file, reader: bufio.NewReader(file), line: 1}, nil
+}
+
+// errorAt adds the line and offset to the given error
+func (lc *lineCounter) errorAt(offset int64, err error) error {
+	for lc.offset < offset {
+		c, readErr := lc.reader.ReadByte()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("offset %d: %v", offset, err)
+		}
+		lc.offset++
+		if c == '\n' {
+			lc.line++
+		}
+	}
+	return fmt.Errorf("line %d, offset %d: %v", lc.line, offset, err)
+}
+
+func (lc *lineCounter) Close() error {
+	return lc.file.Close()
+}
@@ -0,0 +1,117 @@
+package locationhistory_test
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+// benchmarkWaypoints is the number of waypoints generated for the query benchmarks, spread over benchmarkTopics
+var benchmarkWaypoints = flag.Int("benchmark.waypoints", 3000000, "number of waypoints generated for the query benchmarks")
+
+const (
+	benchmarkTopics = 2
+	// benchmarkInterval is the time between two generated waypoints of a topic
+	benchmarkInterval = 30 * time.Second
+	// benchmarkBatchSize is the number of waypoints added per transaction when generating data
+	benchmarkBatchSize = 10000
+)
+
+// benchmarkWindows are the time ranges typically requested from the history
+var benchmarkWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"day", 24 * time.Hour},
+	{"week", 7 * 24 * time.Hour},
+	{"year", 365 * 24 * time.Hour},
+}
+
+// BenchmarkGetWaypoints measures querying a day, week and year of a topic from a generated location history. The
+// history is generated once per database into a temporary SQLite database and into the PostgreSQL test database if
+// configured.
+func BenchmarkGetWaypoints(b *testing.B) {
+	b.Run("sqlite", func(b *testing.B) {
+		benchmarkGetWaypoints(b, openStore(b, configuration.DatabaseConfig{
+			DriverName: "sqlite3",
+			Dsn:        filepath.Join(b.TempDir(), "benchmark.db"),
+		}))
+	})
+	b.Run("postgres", func(b *testing.B) {
+		benchmarkGetWaypoints(b, openPostgres(b))
+	})
+}
+
+func benchmarkGetWaypoints(b *testing.B, store locationhistory.Store) {
+	perTopic := *benchmarkWaypoints / benchmarkTopics
+	end := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	start := end.Add(-time.Duration(perTopic-1) * benchmarkInterval)
+	topics := make([]string, benchmarkTopics)
+	random := rand.New(rand.NewSource(1))
+	for i := range topics {
+		topics[i] = fmt.Sprintf("benchmark/device%d", i+1)
+		err := generateWaypoints(store, topics[i], perTopic, start, random)
+		if err != nil {
+			b.Fatalf("unable to generate waypoints: %v", err)
+		}
+	}
+
+	span := end.Sub(start)
+	for _, window := range benchmarkWindows {
+		window := window
+		b.Run(window.name, func(b *testing.B) {
+			if window.duration > span {
+				b.Skipf("the generated history only spans %s", span)
+			}
+			// no limit as the whole window is requested
+			maxCount := perTopic
+			queried := 0
+			for i := 0; i < b.N; i++ {
+				topic := topics[random.Intn(len(topics))]
+				from := start.Add(time.Duration(random.Int63n(int64(span - window.duration + 1))))
+				to := from.Add(window.duration)
+				waypoints, err := store.GetWaypoints(topic, &from, &to, &maxCount)
+				if err != nil {
+					b.Fatal(err)
+				}
+				queried += len(waypoints)
+			}
+			b.ReportMetric(float64(queried)/float64(b.N), "waypoints/op")
+		})
+	}
+}
+
+// generateWaypoints adds a random walk of count waypoints starting at a random position to the given topic
+func generateWaypoints(store locationhistory.Store, topic string, count int, start time.Time, random *rand.Rand) error {
+	latitude := 47 + random.Float64()*8
+	longitude := 6 + random.Float64()*9
+	datetime := start
+	for added := 0; added < count; {
+		tx, err := store.OpenTransaction()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < benchmarkBatchSize && added < count; i++ {
+			latitude += (random.Float64() - 0.5) / 1000
+			longitude += (random.Float64() - 0.5) / 1000
+			err = tx.AddWaypointData(topic, latitude, longitude, datetime)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			datetime = datetime.Add(benchmarkInterval)
+			added++
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package locationhistory
+
+import "time"
+
+// DeadLetter is a message which was rejected and is kept for inspection or later replay
+type DeadLetter struct {
+	ID       int       `json:"id"`
+	Topic    string    `json:"topic"`
+	Payload  string    `json:"payload"`
+	Received time.Time `json:"received"`
+	Reason   string    `json:"reason"`
+	Source   string    `json:"source,omitempty"`
+}
+
+const deadLetterTable = `CREATE TABLE IF NOT EXISTS DEADLETTERS (ID {{id}},
+					Topic TEXT NOT NULL,
+					Payload TEXT NOT NULL,
+					Received {{timestamp}} NOT NULL,
+					Reason TEXT NOT NULL)`
+
+// AddDeadLetter stores a rejected message
+func (ldb *LocationDatabase) AddDeadLetter(deadLetter DeadLetter) error {
+	_, err := ldb.exec(`INSERT INTO DEADLETTERS(Topic, Payload, Received, Reason, Source) VALUES (?, ?, ?, ?, ?)`,
+		deadLetter.Topic, deadLetter.Payload, deadLetter.Received, deadLetter.Reason, deadLetter.Source)
+	return err
+}
+
+// GetDeadLetters returns all dead letters ordered by the time they were received
+func (ldb *LocationDatabase) GetDeadLetters() ([]DeadLetter, error) {
+	rows, err := ldb.query(`SELECT ID, Topic, Payload, Received, Reason, COALESCE(Source, '') FROM DEADLETTERS
+		ORDER BY Received ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := make([]DeadLetter, 0)
+
+	for rows.Next() {
+		var deadLetter DeadLetter
+		err = rows.Scan(&deadLetter.ID, &deadLetter.Topic, &deadLetter.Payload, &deadLetter.Received, &deadLetter.Reason,
+			&deadLetter.Source)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	return deadLetters, rows.Err()
+}
+
+// DeleteDeadLetter removes the dead letter with the given ID
+func (ldb *LocationDatabase) DeleteDeadLetter(id int) error {
+	_, err := ldb.exec(`DELETE FROM DEADLETTERS WHERE ID = ?`, id)
+	return err
+}
+
+// PurgeDeadLetters removes all dead letters and returns the number of removed dead letters
+func (ldb *LocationDatabase) PurgeDeadLetters() (int64, error) {
+	result, err := ldb.exec(`DELETE FROM DEADLETTERS`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
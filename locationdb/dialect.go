@@ -0,0 +1,273 @@
+package locationhistory
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dialect contains everything specific to the SQL database used by a LocationDatabase. Statements are written using ?
+// placeholders and the type placeholders {{id}}, {{double}} and {{timestamp}} in DDL.
+type dialect interface {
+	// rebind converts a statement using ? placeholders into the placeholder syntax of the database
+	rebind(statement string) string
+	// bind converts the arguments of a statement into the values passed to the database
+	bind(args []interface{}) []interface{}
+	// ddl replaces the type placeholders in the given DDL statement
+	ddl(statement string) string
+	// columns returns the lower case names of all columns of the given table, the result is empty if the table does
+	// not exist
+	columns(q queryer, table string) (map[string]bool, error)
+	// init is called after all tables have been created
+	init(db *sql.DB) error
+	// bboxCondition returns the condition restricting waypoints to the given bounding box and its arguments
+	bboxCondition(bbox BoundingBox) (string, []interface{})
+	// nearCondition returns the condition restricting waypoints to the given circle and its arguments
+	nearCondition(circle Circle) (string, []interface{})
+	// spatialIndex returns the statements creating the spatial index of the waypoints
+	spatialIndex() []string
+}
+
+// queryer is implemented by both database connections and transactions
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// newDialect returns the dialect for the given driver name
+func newDialect(driverName string, postGIS bool) (dialect, error) {
+	switch driverName {
+	case "sqlite3":
+		return sqliteDialect{}, nil
+	case "postgres", "pgx":
+		return postgresDialect{postGIS: postGIS}, nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver '%s', use sqlite3 or postgres", driverName)
+	}
+}
+
+// bboxCondition is the bounding box condition used if no spatial index is available
+func bboxCondition(bbox BoundingBox) (string, []interface{}) {
+	return "Latitude BETWEEN ? AND ? AND Longitude BETWEEN ? AND ?",
+		[]interface{}{bbox.MinLatitude, bbox.MaxLatitude, bbox.MinLongitude, bbox.MaxLongitude}
+}
+
+// nearCondition restricts waypoints to the bounding box of the circle first, so the spatial index of the dialect is
+// used, and then to the circle itself. The distance is approximated by an equirectangular projection as it only
+// requires arithmetic supported by all databases, which is precise enough for radii up to some kilometres. Circles
+// crossing the antimeridian are checked on each side separately.
+func nearCondition(circle Circle, bboxCondition func(BoundingBox) (string, []interface{})) (string, []interface{}) {
+	scale := math.Cos(circle.Latitude * math.Pi / 180)
+	radius := circle.Radius / metersPerDegree
+	conditions := make([]string, 0, 2)
+	args := make([]interface{}, 0)
+	for _, bbox := range circle.BoundingBoxes() {
+		condition, bboxArgs := bboxCondition(bbox)
+		longitude := circle.longitudeNear(bbox)
+		conditions = append(conditions,
+			condition+" AND (Latitude - ?) * (Latitude - ?) + (Longitude - ?) * (Longitude - ?) * ? <= ?")
+		args = append(args, bboxArgs...)
+		args = append(args, circle.Latitude, circle.Latitude, longitude, longitude, scale*scale, radius*radius)
+	}
+	if len(conditions) == 1 {
+		return conditions[0], args
+	}
+	return "((" + strings.Join(conditions, ") OR (") + "))", args
+}
+
+type sqliteDialect struct{}
+
+var sqliteTypes = strings.NewReplacer(
+	"{{id}}", "INTEGER PRIMARY KEY AUTOINCREMENT",
+	"{{double}}", "DOUBLE",
+	"{{timestamp}}", "TIMESTAMP",
+)
+
+func (sqliteDialect) rebind(statement string) string {
+	return statement
+}
+
+// bind converts all times to UTC. SQLite stores times as text including their offset and compares them as strings,
+// which only orders them correctly if all of them have the same offset.
+func (sqliteDialect) bind(args []interface{}) []interface{} {
+	bound := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch value := arg.(type) {
+		case time.Time:
+			bound[i] = value.UTC()
+		case *time.Time:
+			if value != nil {
+				bound[i] = value.UTC()
+			} else {
+				bound[i] = arg
+			}
+		default:
+			bound[i] = arg
+		}
+	}
+	return bound
+}
+
+func (sqliteDialect) ddl(statement string) string {
+	return sqliteTypes.Replace(statement)
+}
+
+func (sqliteDialect) columns(q queryer, table string) (map[string]bool, error) {
+	rows, err := q.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid int
+		var name, columnType string
+		var notNull, primaryKey int
+		var defaultValue sql.NullString
+		err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey)
+		if err != nil {
+			return nil, err
+		}
+		columns[strings.ToLower(name)] = true
+	}
+	return columns, rows.Err()
+}
+
+func (sqliteDialect) init(db *sql.DB) error {
+	return nil
+}
+
+// bboxCondition uses the R*Tree index to find candidates. As the R*Tree stores rounded coordinates, the exact position
+// is checked as well.
+func (sqliteDialect) bboxCondition(bbox BoundingBox) (string, []interface{}) {
+	condition, args := bboxCondition(bbox)
+	return `ID IN (SELECT ID FROM WAYPOINTS_RTREE WHERE MaxLatitude >= ? AND MinLatitude <= ? AND MaxLongitude >= ?
+		AND MinLongitude <= ?) AND ` + condition,
+		append([]interface{}{bbox.MinLatitude, bbox.MaxLatitude, bbox.MinLongitude, bbox.MaxLongitude}, args...)
+}
+
+func (d sqliteDialect) nearCondition(circle Circle) (string, []interface{}) {
+	return nearCondition(circle, d.bboxCondition)
+}
+
+// spatialIndex creates an R*Tree containing the position of every waypoint. It is kept in sync with the WAYPOINTS
+// table by triggers.
+func (sqliteDialect) spatialIndex() []string {
+	return []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS WAYPOINTS_RTREE USING rtree(ID, MinLatitude, MaxLatitude, MinLongitude,
+			MaxLongitude)`,
+		`INSERT INTO WAYPOINTS_RTREE SELECT ID, Latitude, Latitude, Longitude, Longitude FROM WAYPOINTS
+			WHERE ID NOT IN (SELECT ID FROM WAYPOINTS_RTREE)`,
+		`CREATE TRIGGER IF NOT EXISTS waypoints_rtree_insert AFTER INSERT ON WAYPOINTS BEGIN
+			INSERT INTO WAYPOINTS_RTREE VALUES (NEW.ID, NEW.Latitude, NEW.Latitude, NEW.Longitude, NEW.Longitude);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS waypoints_rtree_update AFTER UPDATE OF Latitude, Longitude ON WAYPOINTS BEGIN
+			UPDATE WAYPOINTS_RTREE SET MinLatitude = NEW.Latitude, MaxLatitude = NEW.Latitude,
+				MinLongitude = NEW.Longitude, MaxLongitude = NEW.Longitude WHERE ID = NEW.ID;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS waypoints_rtree_delete AFTER DELETE ON WAYPOINTS BEGIN
+			DELETE FROM WAYPOINTS_RTREE WHERE ID = OLD.ID;
+		END`,
+	}
+}
+
+// postgresDialect supports PostgreSQL, optionally using a PostGIS geography column with a GiST index for spatial
+// queries
+type postgresDialect struct {
+	postGIS bool
+}
+
+var postgresTypes = strings.NewReplacer(
+	"{{id}}", "BIGSERIAL PRIMARY KEY",
+	"{{double}}", "DOUBLE PRECISION",
+	"{{timestamp}}", "TIMESTAMPTZ",
+)
+
+func (postgresDialect) rebind(statement string) string {
+	var builder strings.Builder
+	n := 0
+	for _, c := range statement {
+		if c == '?' {
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+		} else {
+			builder.WriteRune(c)
+		}
+	}
+	return builder.String()
+}
+
+// bind passes all arguments unchanged, as PostgreSQL compares times with time zone by the instant they refer to
+func (postgresDialect) bind(args []interface{}) []interface{} {
+	return args
+}
+
+func (postgresDialect) ddl(statement string) string {
+	return postgresTypes.Replace(statement)
+}
+
+func (postgresDialect) columns(q queryer, table string) (map[string]bool, error) {
+	// unquoted identifiers are folded to lower case by PostgreSQL
+	rows, err := q.Query(`SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema()
+		AND table_name = $1`, strings.ToLower(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		columns[strings.ToLower(name)] = true
+	}
+	return columns, rows.Err()
+}
+
+func (d postgresDialect) init(db *sql.DB) error {
+	if !d.postGIS {
+		return nil
+	}
+	log.Debug("Setting up PostGIS position column")
+	statements := []string{
+		`CREATE EXTENSION IF NOT EXISTS postgis`,
+		`ALTER TABLE WAYPOINTS ADD COLUMN IF NOT EXISTS Position geography(Point, 4326)
+			GENERATED ALWAYS AS (ST_SetSRID(ST_MakePoint(Longitude, Latitude), 4326)::geography) STORED`,
+		`CREATE INDEX IF NOT EXISTS waypoints_position ON WAYPOINTS USING GIST (Position)`,
+	}
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d postgresDialect) bboxCondition(bbox BoundingBox) (string, []interface{}) {
+	if !d.postGIS {
+		return bboxCondition(bbox)
+	}
+	return "Position && ST_MakeEnvelope(?, ?, ?, ?, 4326)::geography",
+		[]interface{}{bbox.MinLongitude, bbox.MinLatitude, bbox.MaxLongitude, bbox.MaxLatitude}
+}
+
+func (d postgresDialect) nearCondition(circle Circle) (string, []interface{}) {
+	if !d.postGIS {
+		return nearCondition(circle, d.bboxCondition)
+	}
+	return "ST_DWithin(Position, ST_SetSRID(ST_MakePoint(?, ?), 4326)::geography, ?)",
+		[]interface{}{circle.Longitude, circle.Latitude, circle.Radius}
+}
+
+// spatialIndex indexes the plain coordinates, PostGIS indexes its position column when the dialect is initialized
+// as it is optional
+func (postgresDialect) spatialIndex() []string {
+	return []string{`CREATE INDEX IF NOT EXISTS waypoints_position_plain ON WAYPOINTS (Latitude, Longitude)`}
+}
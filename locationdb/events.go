@@ -0,0 +1,155 @@
+package locationhistory
+
+import "time"
+
+// Transition is recorded whenever a device enters or leaves a monitored region
+type Transition struct {
+	ID           int        `json:"id"`
+	Topic        string     `json:"topic"`
+	Event        string     `json:"event"`
+	RegionID     *string    `json:"regionId,omitempty"`
+	Description  *string    `json:"description,omitempty"`
+	Latitude     float64    `json:"latitude"`
+	Longitude    float64    `json:"longitude"`
+	Accuracy     *int       `json:"accuracy,omitempty"`
+	Trigger      *string    `json:"trigger,omitempty"`
+	TrackerID    *string    `json:"trackerId,omitempty"`
+	Datetime     time.Time  `json:"time"`
+	RegionTime   *time.Time `json:"regionTime,omitempty"`
+	ReceivedTime time.Time  `json:"receivedTime"`
+}
+
+// Region is a circular region or beacon monitored by a device. Regions are identified by their topic and the time
+// they were created on the device.
+type Region struct {
+	Topic       string    `json:"topic"`
+	Created     time.Time `json:"created"`
+	RegionID    *string   `json:"regionId,omitempty"`
+	Description string    `json:"description"`
+	Latitude    float64   `json:"latitude"`
+	Longitude   float64   `json:"longitude"`
+	Radius      int       `json:"radius"`
+	UUID        *string   `json:"uuid,omitempty"`
+	Major       *int      `json:"major,omitempty"`
+	Minor       *int      `json:"minor,omitempty"`
+}
+
+// Card contains the name and avatar a user published for a topic
+type Card struct {
+	Topic     string    `json:"topic"`
+	Name      string    `json:"name"`
+	Face      *string   `json:"face,omitempty"`
+	TrackerID *string   `json:"trackerId,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// DeviceEvent is any other message of a device worth keeping, e.g. the last will sent by the broker when a device goes
+// offline. The original message is kept as payload.
+type DeviceEvent struct {
+	ID       int       `json:"id"`
+	Topic    string    `json:"topic"`
+	Type     string    `json:"type"`
+	Datetime time.Time `json:"time"`
+	Payload  string    `json:"payload"`
+}
+
+// eventTables are the tables for all non-location data sent by devices
+var eventTables = []string{
+	`CREATE TABLE IF NOT EXISTS TRANSITIONS (ID {{id}},
+					Topic TEXT NOT NULL,
+					Event TEXT NOT NULL,
+					RegionID TEXT,
+					Description TEXT,
+					Latitude {{double}} NOT NULL,
+					Longitude {{double}} NOT NULL,
+					Accuracy INTEGER,
+					TriggerType TEXT,
+					TrackerID TEXT,
+					Time {{timestamp}} NOT NULL,
+					RegionTime {{timestamp}},
+					ReceivedTime {{timestamp}} NOT NULL,
+					CONSTRAINT transition_unique UNIQUE (Topic, Event, Time))`,
+	`CREATE TABLE IF NOT EXISTS REGIONS (Topic TEXT NOT NULL,
+					Created {{timestamp}} NOT NULL,
+					RegionID TEXT,
+					Description TEXT NOT NULL,
+					Latitude {{double}} NOT NULL,
+					Longitude {{double}} NOT NULL,
+					Radius INTEGER NOT NULL,
+					UUID TEXT,
+					Major INTEGER,
+					Minor INTEGER,
+					PRIMARY KEY (Topic, Created))`,
+	`CREATE TABLE IF NOT EXISTS CARDS (Topic TEXT NOT NULL PRIMARY KEY,
+					Name TEXT NOT NULL,
+					Face TEXT,
+					TrackerID TEXT,
+					Updated {{timestamp}} NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS EVENTS (ID {{id}},
+					Topic TEXT NOT NULL,
+					Type TEXT NOT NULL,
+					Time {{timestamp}} NOT NULL,
+					Payload TEXT NOT NULL)`,
+}
+
+// AddTransition stores the given region transition. Transitions which have already been stored are ignored.
+func (ldb *LocationDatabase) AddTransition(transition Transition) error {
+	_, err := ldb.exec(`INSERT INTO TRANSITIONS(Topic, Event, RegionID, Description, Latitude, Longitude, Accuracy,
+		TriggerType, TrackerID, Time, RegionTime, ReceivedTime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`,
+		transition.Topic, transition.Event, transition.RegionID, transition.Description, transition.Latitude,
+		transition.Longitude, transition.Accuracy, transition.Trigger, transition.TrackerID, transition.Datetime,
+		transition.RegionTime, transition.ReceivedTime)
+	return err
+}
+
+// SaveRegion stores the given region definition replacing any previous definition with the same topic and creation
+// time
+func (ldb *LocationDatabase) SaveRegion(region Region) error {
+	_, err := ldb.exec(`INSERT INTO REGIONS(Topic, Created, RegionID, Description, Latitude, Longitude, Radius, UUID,
+		Major, Minor) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (Topic, Created) DO UPDATE SET RegionID = excluded.RegionID, Description = excluded.Description,
+		Latitude = excluded.Latitude, Longitude = excluded.Longitude, Radius = excluded.Radius, UUID = excluded.UUID,
+		Major = excluded.Major, Minor = excluded.Minor`,
+		region.Topic, region.Created, region.RegionID, region.Description, region.Latitude, region.Longitude,
+		region.Radius, region.UUID, region.Major, region.Minor)
+	return err
+}
+
+// SaveCard stores the given card replacing the previous card of the same topic
+func (ldb *LocationDatabase) SaveCard(card Card) error {
+	_, err := ldb.exec(`INSERT INTO CARDS(Topic, Name, Face, TrackerID, Updated) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (Topic) DO UPDATE SET Name = excluded.Name, Face = excluded.Face, TrackerID = excluded.TrackerID,
+		Updated = excluded.Updated`,
+		card.Topic, card.Name, card.Face, card.TrackerID, card.Updated)
+	return err
+}
+
+// AddDeviceEvent stores the given device event
+func (ldb *LocationDatabase) AddDeviceEvent(event DeviceEvent) error {
+	_, err := ldb.exec(`INSERT INTO EVENTS(Topic, Type, Time, Payload) VALUES (?, ?, ?, ?)`,
+		event.Topic, event.Type, event.Datetime, event.Payload)
+	return err
+}
+
+// GetCards returns the cards of all topics
+func (ldb *LocationDatabase) GetCards() ([]Card, error) {
+	rows, err := ldb.query(`SELECT Topic, Name, Face, TrackerID, Updated FROM CARDS ORDER BY Topic ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := make([]Card, 0)
+
+	for rows.Next() {
+		var card Card
+		err = rows.Scan(&card.Topic, &card.Name, &card.Face, &card.TrackerID, &card.Updated)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+
+	return cards, rows.Err()
+}
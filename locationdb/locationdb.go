@@ -2,86 +2,179 @@ package locationhistory
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	"github.com/dfleischhacker/locationhistory-collector/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
-// LocationDatabase provides a way to store and retrieve location data
+// LocationDatabase implements the Store on top of an SQL database
 type LocationDatabase struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect dialect
 }
 
-// Waypoint is the content of a single location message
+// Waypoint is the content of a single location message. Apart from the position and time, all fields are optional
+// and nil if the source of the waypoint did not provide them.
 type Waypoint struct {
-	ID        int       `json:"id"`
-	Topic     string    `json:"topic"`
-	Latitude  float64   `json:"latitude"`
-	Longitude float64   `json:"longitude"`
-	Datetime  time.Time `json:"time"`
+	ID               int       `json:"id"`
+	Topic            string    `json:"topic"`
+	Latitude         float64   `json:"latitude"`
+	Longitude        float64   `json:"longitude"`
+	Datetime         time.Time `json:"time"`
+	Accuracy         *int      `json:"accuracy,omitempty"`
+	Altitude         *int      `json:"altitude,omitempty"`
+	VerticalAccuracy *int      `json:"verticalAccuracy,omitempty"`
+	Velocity         *int      `json:"velocity,omitempty"`
+	Course           *int      `json:"course,omitempty"`
+	Battery          *int      `json:"battery,omitempty"`
+	BatteryState     *int      `json:"batteryState,omitempty"`
+	Pressure         *float64  `json:"pressure,omitempty"`
+	Trigger          *string   `json:"trigger,omitempty"`
+	Connectivity     *string   `json:"connectivity,omitempty"`
+	TrackerID        *string   `json:"trackerId,omitempty"`
+	SSID             *string   `json:"ssid,omitempty"`
+	BSSID            *string   `json:"bssid,omitempty"`
+	InRegions        []string  `json:"inRegions,omitempty"`
+	Source           *string   `json:"source,omitempty"`
 }
 
+// waypointColumns lists the columns of the WAYPOINTS table in the order used by insertWaypointSQL and scanWaypoint
+const waypointColumns = `ID, Topic, Latitude, Longitude, Time, Accuracy, Altitude, VerticalAccuracy, Velocity, Course,
+	Battery, BatteryState, Pressure, TriggerType, Connectivity, TrackerID, SSID, BSSID, InRegions, Source`
+
+// insertWaypointSQL inserts a waypoint unless it already exists. Conflicts are not raised as errors as they would
+// abort the whole transaction on some databases.
+const insertWaypointSQL = `INSERT INTO WAYPOINTS(Topic, Latitude, Longitude, Time, Accuracy, Altitude, VerticalAccuracy,
+	Velocity, Course, Battery, BatteryState, Pressure, TriggerType, Connectivity, TrackerID, SSID, BSSID, InRegions,
+	Source) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`
+
+// optionalWaypointColumns are the columns added after the initial version of the WAYPOINTS table together with their
+// types. They are added to existing databases by the migration to schema version 2.
+var optionalWaypointColumns = [][2]string{
+	{"Accuracy", "INTEGER"},
+	{"Altitude", "INTEGER"},
+	{"VerticalAccuracy", "INTEGER"},
+	{"Velocity", "INTEGER"},
+	{"Course", "INTEGER"},
+	{"Battery", "INTEGER"},
+	{"BatteryState", "INTEGER"},
+	{"Pressure", "{{double}}"},
+	{"TriggerType", "TEXT"},
+	{"Connectivity", "TEXT"},
+	{"TrackerID", "TEXT"},
+	{"SSID", "TEXT"},
+	{"BSSID", "TEXT"},
+	{"InRegions", "TEXT"},
+}
+
+// updateLatestSQL records the given waypoint as latest waypoint of its topic unless a later one is already known
+const updateLatestSQL = `INSERT INTO LATEST_WAYPOINTS(Topic, Time, WaypointID)
+	SELECT Topic, Time, ID FROM WAYPOINTS WHERE Topic = ? AND Latitude = ? AND Longitude = ? AND Time = ?
+	ON CONFLICT (Topic) DO UPDATE SET Time = excluded.Time, WaypointID = excluded.WaypointID
+	WHERE excluded.Time >= LATEST_WAYPOINTS.Time`
+
+// RunningTransaction adds many waypoints to the database in a single transaction
 type RunningTransaction struct {
-	tx   *sql.Tx
-	stmt *sql.Stmt
+	tx      *sql.Tx
+	stmt    *sql.Stmt
+	dialect dialect
+	// latest contains the latest waypoint added per topic, which is recorded in LATEST_WAYPOINTS on commit
+	latest map[string]Waypoint
+	// added is the number of waypoints inserted, not counting ignored duplicates
+	added int
+}
+
+// OpenLocationDatabase opens a new Store based on the connection information provided in the given config. The SQL
+// dialect is chosen by the driver name. All pending migrations are applied to the database.
+func OpenLocationDatabase(config configuration.DatabaseConfig) (Store, error) {
+	locationDatabase, err := ConnectLocationDatabase(config)
+	if err != nil {
+		return nil, err
+	}
+	err = locationDatabase.Migrate(false, func(migration Migration, statements []string) {
+		log.Infof("Migrating database to version %d: %s", migration.Version, migration.Description)
+	})
+	if err != nil {
+		locationDatabase.Close()
+		return nil, fmt.Errorf("error migrating database: %v", err)
+	}
+	err = locationDatabase.dialect.init(locationDatabase.db)
+	if err != nil {
+		locationDatabase.Close()
+		return nil, fmt.Errorf("error initializing database: %v", err)
+	}
+	return locationDatabase, nil
 }
 
-// OpenLocationDatabase opens a new LocationDatabase based on the connection information provided in the given config.
-func OpenLocationDatabase(config configuration.DatabaseConfig) LocationDatabase {
+// ConnectLocationDatabase opens the database described by the given config without changing its schema
+func ConnectLocationDatabase(config configuration.DatabaseConfig) (*LocationDatabase, error) {
+	dialect, err := newDialect(config.DriverName, config.PostGIS)
+	if err != nil {
+		return nil, err
+	}
 	db, err := sql.Open(config.DriverName, config.Dsn)
 	if err != nil {
-		log.Fatalf("Unable to open the database connection: %s", err)
+		return nil, fmt.Errorf("unable to open the database connection: %v", err)
 	}
+	return &LocationDatabase{db: db, dialect: dialect}, nil
+}
 
-	initDb(db)
+// exec executes the given statement written with ? placeholders
+func (ldb *LocationDatabase) exec(statement string, args ...interface{}) (sql.Result, error) {
+	return ldb.db.Exec(ldb.dialect.rebind(statement), ldb.dialect.bind(args)...)
+}
+
+// query runs the given query written with ? placeholders
+func (ldb *LocationDatabase) query(statement string, args ...interface{}) (*sql.Rows, error) {
+	return ldb.db.Query(ldb.dialect.rebind(statement), ldb.dialect.bind(args)...)
+}
 
-	locationDatabase := LocationDatabase{}
-	locationDatabase.db = db
-	return locationDatabase
+// Close closes the database connection
+func (ldb *LocationDatabase) Close() error {
+	return ldb.db.Close()
 }
 
-func initDb(db *sql.DB) {
-	_, err := db.Exec(
-		`CREATE TABLE IF NOT EXISTS WAYPOINTS (ID INTEGER PRIMARY KEY AUTOINCREMENT,
-					Topic TEXT NOT NULL,
-					Latitude DOUBLE NOT NULL,
-					Longitude DOUBLE NOT NULL,
-					Time TIMESTAMP NOT NULL,
-					CONSTRAINT all_unique UNIQUE (Topic, Latitude, Longitude, Time))`)
+// CheckWritable returns an error if the database does not accept writes, e.g. because it is read-only. The check
+// deletes no rows and is rolled back, so the database is never modified.
+func (ldb *LocationDatabase) CheckWritable() error {
+	tx, err := ldb.db.Begin()
 	if err != nil {
-		log.Fatal("Error creating database tables", err)
+		return err
 	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM WAYPOINTS WHERE 1 = 0`)
+	return err
 }
 
 // AddWaypointData stores a waypoint with the given information into the database and commits the change
-func (ldb *LocationDatabase) AddWaypointData(topic string, latitude float64, longitude float64, datetime time.Time) {
-	tx, err := ldb.db.Begin()
+func (ldb *LocationDatabase) AddWaypointData(topic string, latitude float64, longitude float64, datetime time.Time) error {
+	return ldb.AddWaypoint(Waypoint{Topic: topic, Latitude: latitude, Longitude: longitude, Datetime: datetime})
+}
+
+// AddWaypoint stores the given waypoint including all of its optional fields into the database and commits the change
+func (ldb *LocationDatabase) AddWaypoint(waypoint Waypoint) error {
+	tx, err := ldb.OpenTransaction()
 	if err != nil {
-		log.Fatal("Unable to open transaction", err)
+		return fmt.Errorf("unable to open transaction: %v", err)
 	}
-	stmt, err := tx.Prepare(`INSERT INTO WAYPOINTS(topic, latitude, longitude, time) VALUES (?, ?, ?, ?)`)
+	err = tx.add(waypoint)
 	if err != nil {
-		log.Fatal("Unable to prepare insert statement: ", err)
+		tx.Rollback()
+		return fmt.Errorf("unable to write waypoint: %v", err)
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(topic, latitude, longitude, datetime)
+	err = tx.Commit()
 	if err != nil {
-		if !strings.HasPrefix(err.Error(), "UNIQUE constraint failed:") {
-			log.Warn("Unable to write entry to database: ", err)
-		} else {
-			log.Info("Received duplicate location message, ignoring it")
-		}
-		tx.Rollback()
-	} else {
-		tx.Commit()
+		return fmt.Errorf("unable to commit waypoint: %v", err)
 	}
-}
-
-func (ldb *LocationDatabase) AddWaypoint(waypoint Waypoint) {
-	ldb.AddWaypointData(waypoint.Topic, waypoint.Latitude, waypoint.Longitude, waypoint.Datetime)
+	return nil
 }
 
 // GetWaypoints returns all waypoints for a given topic name
@@ -104,11 +197,12 @@ func (ldb *LocationDatabase) GetWaypoints(topic string, startRef *time.Time, end
 	} else {
 		maxCount = *maxCountRef
 	}
-	stmt, err := ldb.db.Prepare(`SELECT * FROM WAYPOINTS WHERE topic = ? AND Time >= ? AND Time <= ? ORDER BY time ASC LIMIT ?`)
+	stmt, err := ldb.db.Prepare(ldb.dialect.rebind(`SELECT ` + waypointColumns + ` FROM WAYPOINTS
+		WHERE topic = ? AND Time >= ? AND Time <= ? ORDER BY time ASC LIMIT ?`))
 	if err != nil {
 		return nil, err
 	}
-	rows, err := stmt.Query(topic, start, end, maxCount)
+	rows, err := stmt.Query(ldb.dialect.bind([]interface{}{topic, start, end, maxCount})...)
 
 	if err != nil {
 		return nil, err
@@ -118,17 +212,288 @@ func (ldb *LocationDatabase) GetWaypoints(topic string, startRef *time.Time, end
 	waypoints := make([]Waypoint, 0)
 
 	for rows.Next() {
-		var waypoint Waypoint
-		_ = rows.Scan(&waypoint.ID, &waypoint.Topic, &waypoint.Latitude, &waypoint.Longitude, &waypoint.Datetime)
+		waypoint, err := scanWaypoint(rows)
+		if err != nil {
+			return nil, err
+		}
 		waypoints = append(waypoints, waypoint)
 	}
 
 	return waypoints, nil
 }
 
+// WaypointQuery selects the waypoints returned by ForEachWaypoint and QueryWaypoints
+type WaypointQuery struct {
+	// Topics to select waypoints from, all topics if empty
+	Topics []string
+	// From is the earliest time of selected waypoints, unbounded if zero
+	From time.Time
+	// To is the latest time of selected waypoints, unbounded if zero
+	To time.Time
+	// Limit is the maximum number of selected waypoints, unlimited if zero
+	Limit int
+	// Descending returns the most recent waypoints first instead of the oldest
+	Descending bool
+	// BBox restricts the selected waypoints to the given area, unrestricted if nil
+	BBox *BoundingBox
+	// Near restricts the selected waypoints to the given circle, unrestricted if nil
+	Near *Circle
+	// After selects only waypoints following the given cursor in the order of the query, used for paging
+	After *Cursor
+}
+
+// BoundingBox is a rectangular area given by its south-western and north-eastern corner. A minimum longitude greater
+// than the maximum longitude denotes a box crossing the antimeridian.
+type BoundingBox struct {
+	MinLatitude  float64
+	MinLongitude float64
+	MaxLatitude  float64
+	MaxLongitude float64
+}
+
+// Split returns the box itself or, if it crosses the antimeridian, one box on each side
+func (bbox BoundingBox) Split() []BoundingBox {
+	if bbox.MinLongitude <= bbox.MaxLongitude {
+		return []BoundingBox{bbox}
+	}
+	west, east := bbox, bbox
+	west.MaxLongitude = 180
+	east.MinLongitude = -180
+	return []BoundingBox{west, east}
+}
+
+// metersPerDegree is the length of a degree of latitude
+const metersPerDegree = 111320
+
+// Circle is the area within Radius meters around a position
+type Circle struct {
+	Latitude  float64
+	Longitude float64
+	Radius    float64
+}
+
+// BoundingBoxes returns the smallest bounding boxes containing the circle. Usually, this is a single box, but if the
+// circle crosses the antimeridian, it is split into one box on each side.
+func (circle Circle) BoundingBoxes() []BoundingBox {
+	latitudeDelta := circle.Radius / metersPerDegree
+	bbox := BoundingBox{
+		MinLatitude:  math.Max(circle.Latitude-latitudeDelta, -90),
+		MaxLatitude:  math.Min(circle.Latitude+latitudeDelta, 90),
+		MinLongitude: -180,
+		MaxLongitude: 180,
+	}
+	// close to the poles, the circle covers all longitudes
+	scale := math.Cos(circle.Latitude * math.Pi / 180)
+	longitudeDelta := latitudeDelta / scale
+	if scale <= 0 || longitudeDelta >= 180 {
+		return []BoundingBox{bbox}
+	}
+	bbox.MinLongitude = circle.Longitude - longitudeDelta
+	bbox.MaxLongitude = circle.Longitude + longitudeDelta
+	switch {
+	case bbox.MinLongitude < -180:
+		wrapped := bbox
+		wrapped.MinLongitude += 360
+		wrapped.MaxLongitude = 180
+		bbox.MinLongitude = -180
+		return []BoundingBox{bbox, wrapped}
+	case bbox.MaxLongitude > 180:
+		wrapped := bbox
+		wrapped.MinLongitude = -180
+		wrapped.MaxLongitude -= 360
+		bbox.MaxLongitude = 180
+		return []BoundingBox{bbox, wrapped}
+	}
+	return []BoundingBox{bbox}
+}
+
+// longitudeNear returns the longitude of the circle's center shifted by a full turn if that brings it closer to the
+// given bounding box, so distances to positions on the other side of the antimeridian are computed correctly
+func (circle Circle) longitudeNear(bbox BoundingBox) float64 {
+	switch {
+	case circle.Longitude > bbox.MaxLongitude+180:
+		return circle.Longitude - 360
+	case circle.Longitude < bbox.MinLongitude-180:
+		return circle.Longitude + 360
+	}
+	return circle.Longitude
+}
+
+// Cursor marks the position of a waypoint in the result of a WaypointQuery
+type Cursor struct {
+	Topic    string
+	Datetime time.Time
+	ID       int
+}
+
+// CursorOf returns the cursor pointing at the given waypoint
+func CursorOf(waypoint Waypoint) *Cursor {
+	return &Cursor{Topic: waypoint.Topic, Datetime: waypoint.Datetime, ID: waypoint.ID}
+}
+
+// String encodes the cursor as opaque string
+func (cursor *Cursor) String() string {
+	// the timezone offset is kept as the database compares the stored time strings
+	value := fmt.Sprintf("%d\n%s\n%s", cursor.ID, cursor.Datetime.Format(time.RFC3339Nano), cursor.Topic)
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// ParseCursor decodes a cursor previously encoded by Cursor.String
+func ParseCursor(value string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %v", err)
+	}
+	parts := strings.SplitN(string(data), "\n", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %v", err)
+	}
+	datetime, err := time.Parse(time.RFC3339Nano, parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %v", err)
+	}
+	return &Cursor{Topic: parts[2], Datetime: datetime, ID: id}, nil
+}
+
+// sql builds the statement and its arguments for selecting the waypoints matching the query. Waypoints are ordered by
+// topic and time.
+func (query WaypointQuery) sql(d dialect) (string, []interface{}) {
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	if len(query.Topics) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(query.Topics)), ", ")
+		conditions = append(conditions, "Topic IN ("+placeholders+")")
+		for _, topic := range query.Topics {
+			args = append(args, topic)
+		}
+	}
+	if !query.From.IsZero() {
+		conditions = append(conditions, "Time >= ?")
+		args = append(args, query.From)
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, "Time <= ?")
+		args = append(args, query.To)
+	}
+	if query.BBox != nil {
+		bboxConditions := make([]string, 0, 2)
+		for _, bbox := range query.BBox.Split() {
+			condition, bboxArgs := d.bboxCondition(bbox)
+			bboxConditions = append(bboxConditions, condition)
+			args = append(args, bboxArgs...)
+		}
+		conditions = append(conditions, "(("+strings.Join(bboxConditions, ") OR (")+"))")
+	}
+	if query.Near != nil {
+		condition, nearArgs := d.nearCondition(*query.Near)
+		conditions = append(conditions, condition)
+		args = append(args, nearArgs...)
+	}
+	direction := "ASC"
+	comparison := ">"
+	if query.Descending {
+		direction = "DESC"
+		comparison = "<"
+	}
+	if query.After != nil {
+		conditions = append(conditions, fmt.Sprintf(
+			"(Topic > ? OR (Topic = ? AND (Time %s ? OR (Time = ? AND ID %s ?))))", comparison, comparison))
+		args = append(args, query.After.Topic, query.After.Topic, query.After.Datetime, query.After.Datetime,
+			query.After.ID)
+	}
+
+	statement := `SELECT ` + waypointColumns + ` FROM WAYPOINTS`
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += fmt.Sprintf(" ORDER BY Topic ASC, Time %s, ID %s", direction, direction)
+	if query.Limit > 0 {
+		statement += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+	return statement, args
+}
+
+// ForEachWaypoint calls fn for each waypoint matching the given query. The waypoints are read from the database one by
+// one, so arbitrarily large results can be processed. If fn returns an error, the iteration stops and the error is
+// returned.
+func (ldb *LocationDatabase) ForEachWaypoint(query WaypointQuery, fn func(Waypoint) error) error {
+	statement, args := query.sql(ldb.dialect)
+	rows, err := ldb.query(statement, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		waypoint, err := scanWaypoint(rows)
+		if err != nil {
+			return err
+		}
+		err = fn(waypoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// QueryWaypoints returns all waypoints matching the given query
+func (ldb *LocationDatabase) QueryWaypoints(query WaypointQuery) ([]Waypoint, error) {
+	waypoints := make([]Waypoint, 0)
+	err := ldb.ForEachWaypoint(query, func(waypoint Waypoint) error {
+		waypoints = append(waypoints, waypoint)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return waypoints, nil
+}
+
+// WaypointsInBBox returns the waypoints matching the given query which are located in the given bounding box
+func (ldb *LocationDatabase) WaypointsInBBox(bbox BoundingBox, query WaypointQuery) ([]Waypoint, error) {
+	query.BBox = &bbox
+	return ldb.QueryWaypoints(query)
+}
+
+// WaypointsNear returns the waypoints matching the given query which are located within radius meters around the
+// given position
+func (ldb *LocationDatabase) WaypointsNear(latitude float64, longitude float64, radius float64, query WaypointQuery) ([]Waypoint, error) {
+	query.Near = &Circle{Latitude: latitude, Longitude: longitude, Radius: radius}
+	return ldb.QueryWaypoints(query)
+}
+
+// GetLatestWaypoints returns the most recent waypoint of each topic
+func (ldb *LocationDatabase) GetLatestWaypoints() ([]Waypoint, error) {
+	rows, err := ldb.query(`SELECT ` + waypointColumns + ` FROM WAYPOINTS
+		WHERE ID IN (SELECT WaypointID FROM LATEST_WAYPOINTS) ORDER BY Topic ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	waypoints := make([]Waypoint, 0)
+
+	for rows.Next() {
+		waypoint, err := scanWaypoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		waypoints = append(waypoints, waypoint)
+	}
+
+	return waypoints, rows.Err()
+}
+
 // GetTopics returns all topics for which location data exists
 func (ldb *LocationDatabase) GetTopics() ([]string, error) {
-	rows, err := ldb.db.Query(`SELECT DISTINCT topic FROM WAYPOINTS`)
+	rows, err := ldb.query(`SELECT DISTINCT topic FROM WAYPOINTS`)
 	if err != nil {
 		return nil, err
 	}
@@ -145,38 +510,71 @@ func (ldb *LocationDatabase) GetTopics() ([]string, error) {
 	return topics, nil
 }
 
+// OpenTransaction starts a transaction for adding many waypoints using a single prepared statement
 func (ldb *LocationDatabase) OpenTransaction() (RunningTransaction, error) {
 	runningTx := RunningTransaction{}
 	tx, err := ldb.db.Begin()
 	if err != nil {
 		return runningTx, err
 	}
-	stmt, err := tx.Prepare(`INSERT INTO WAYPOINTS(topic, latitude, longitude, time) VALUES (?, ?, ?, ?)`)
+	stmt, err := tx.Prepare(ldb.dialect.rebind(insertWaypointSQL))
 	if err != nil {
+		tx.Rollback()
 		return runningTx, err
 	}
 	runningTx.tx = tx
 	runningTx.stmt = stmt
+	runningTx.dialect = ldb.dialect
+	runningTx.latest = make(map[string]Waypoint)
 	return runningTx, nil
 }
 
-// AddWaypointData stores a waypoint with the given information into the database and commits the change
-func (rtx *RunningTransaction) AddWaypointData(topic string, latitude float64, longitude float64, datetime time.Time) {
-	_, err := rtx.stmt.Exec(topic, latitude, longitude, datetime)
+// AddWaypointData adds a waypoint with the given information to the transaction
+func (rtx *RunningTransaction) AddWaypointData(topic string, latitude float64, longitude float64, datetime time.Time) error {
+	return rtx.AddWaypoint(Waypoint{Topic: topic, Latitude: latitude, Longitude: longitude, Datetime: datetime})
+}
+
+// AddWaypoint adds the given waypoint including all of its optional fields to the transaction. Duplicates are ignored,
+// all other errors are returned and leave the transaction to be rolled back.
+func (rtx *RunningTransaction) AddWaypoint(waypoint Waypoint) error {
+	return rtx.add(waypoint)
+}
+
+// add adds the given waypoint to the transaction and returns any error raised by the database
+func (rtx *RunningTransaction) add(waypoint Waypoint) error {
+	result, err := rtx.stmt.Exec(rtx.dialect.bind(waypoint.insertArgs())...)
 	if err != nil {
-		if !strings.HasPrefix(err.Error(), "UNIQUE constraint failed:") {
-			log.Warn("Unable to write entry to database: ", err)
-		} else {
-			log.Info("Received duplicate location message, ignoring it")
-		}
+		return err
+	}
+	if isDuplicate(result) {
+		metrics.DuplicatesIgnored.Inc()
+		log.Info("Received duplicate location message, ignoring it")
+		return nil
 	}
+	rtx.added++
+	if latest, ok := rtx.latest[waypoint.Topic]; !ok || !waypoint.Datetime.Before(latest.Datetime) {
+		rtx.latest[waypoint.Topic] = waypoint
+	}
+	return nil
 }
 
-func (rtx *RunningTransaction) AddWaypoint(waypoint Waypoint) {
-	rtx.AddWaypointData(waypoint.Topic, waypoint.Latitude, waypoint.Longitude, waypoint.Datetime)
+// Rollback discards all waypoints added to the transaction
+func (rtx *RunningTransaction) Rollback() error {
+	rtx.stmt.Close()
+	return rtx.tx.Rollback()
 }
 
+// Commit stores all waypoints added to the transaction and updates the latest waypoint of their topics. If the
+// latest waypoints cannot be updated, the transaction is rolled back.
 func (rtx *RunningTransaction) Commit() error {
+	for _, waypoint := range rtx.latest {
+		_, err := rtx.tx.Exec(rtx.dialect.rebind(updateLatestSQL), rtx.dialect.bind([]interface{}{waypoint.Topic,
+			waypoint.Latitude, waypoint.Longitude, waypoint.Datetime})...)
+		if err != nil {
+			rtx.Rollback()
+			return fmt.Errorf("unable to update latest waypoint of topic '%s': %v", waypoint.Topic, err)
+		}
+	}
 	err := rtx.tx.Commit()
 	if err != nil {
 		return err
@@ -185,6 +583,43 @@ func (rtx *RunningTransaction) Commit() error {
 	return err
 }
 
+// insertArgs returns the values of the waypoint in the order expected by insertWaypointSQL
+func (w *Waypoint) insertArgs() []interface{} {
+	var inRegions *string
+	if len(w.InRegions) > 0 {
+		encoded, err := json.Marshal(w.InRegions)
+		if err == nil {
+			value := string(encoded)
+			inRegions = &value
+		}
+	}
+	return []interface{}{w.Topic, w.Latitude, w.Longitude, w.Datetime, w.Accuracy, w.Altitude, w.VerticalAccuracy,
+		w.Velocity, w.Course, w.Battery, w.BatteryState, w.Pressure, w.Trigger, w.Connectivity, w.TrackerID, w.SSID,
+		w.BSSID, inRegions, w.Source}
+}
+
+// scanWaypoint reads a single waypoint from a row selected using waypointColumns
+func scanWaypoint(rows *sql.Rows) (Waypoint, error) {
+	var w Waypoint
+	var inRegions sql.NullString
+	err := rows.Scan(&w.ID, &w.Topic, &w.Latitude, &w.Longitude, &w.Datetime, &w.Accuracy, &w.Altitude,
+		&w.VerticalAccuracy, &w.Velocity, &w.Course, &w.Battery, &w.BatteryState, &w.Pressure, &w.Trigger,
+		&w.Connectivity, &w.TrackerID, &w.SSID, &w.BSSID, &inRegions, &w.Source)
+	if err != nil {
+		return w, err
+	}
+	if inRegions.Valid && inRegions.String != "" {
+		err = json.Unmarshal([]byte(inRegions.String), &w.InRegions)
+	}
+	return w, err
+}
+
+// isDuplicate returns true if an insert ignoring conflicts did not insert anything because the entry already exists
+func isDuplicate(result sql.Result) bool {
+	affected, err := result.RowsAffected()
+	return err == nil && affected == 0
+}
+
 func (w *Waypoint) String() string {
 	return fmt.Sprintf("%s: %f - %f @ %s", w.Topic, w.Latitude, w.Longitude, w.Datetime)
 }
@@ -0,0 +1,148 @@
+package locationhistory_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/locationdb/storetest"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// postgresDSNVariable names the environment variable containing the DSN of a PostgreSQL database used to run the
+// conformance suite against PostgreSQL. All tables are dropped before. PostGIS is used if postGISVariable is set to
+// true as well.
+const (
+	postgresDSNVariable = "LOCATIONHISTORY_TEST_POSTGRES_DSN"
+	postGISVariable     = "LOCATIONHISTORY_TEST_POSTGIS"
+)
+
+func openStore(t testing.TB, config configuration.DatabaseConfig) locationhistory.Store {
+	t.Helper()
+	store, err := locationhistory.OpenLocationDatabase(config)
+	if err != nil {
+		t.Fatalf("unable to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+func TestSQLiteStore(t *testing.T) {
+	store := openStore(t, configuration.DatabaseConfig{
+		DriverName: "sqlite3",
+		Dsn:        "file:storetest?mode=memory&cache=shared",
+	})
+	err := storetest.TestStore(store)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// openPostgres opens the PostgreSQL test database after dropping all tables, so it is empty even if earlier runs left
+// data behind. The test is skipped if no test database is configured.
+func openPostgres(t testing.TB) locationhistory.Store {
+	t.Helper()
+	dsn := os.Getenv(postgresDSNVariable)
+	if dsn == "" {
+		t.Skipf("%s not set", postgresDSNVariable)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`DROP TABLE IF EXISTS LATEST_WAYPOINTS, WAYPOINTS, TRANSITIONS, REGIONS, CARDS, EVENTS,
+		DEADLETTERS, SCHEMA_VERSION`)
+	if err != nil {
+		t.Fatalf("unable to reset database: %v", err)
+	}
+	return openStore(t, configuration.DatabaseConfig{
+		DriverName: "postgres",
+		Dsn:        dsn,
+		PostGIS:    os.Getenv(postGISVariable) == "true",
+	})
+}
+
+func TestPostgresStore(t *testing.T) {
+	err := storetest.TestStore(openPostgres(t))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	zone := time.FixedZone("CEST", 2*60*60)
+	cursor := &locationhistory.Cursor{
+		Topic:    "owntracks/user/phone\nwith newline",
+		Datetime: time.Date(2020, time.August, 1, 12, 30, 15, 123456789, zone),
+		ID:       42,
+	}
+	parsed, err := locationhistory.ParseCursor(cursor.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Topic != cursor.Topic || parsed.ID != cursor.ID || !parsed.Datetime.Equal(cursor.Datetime) {
+		t.Errorf("expected %v but got %v", cursor, parsed)
+	}
+	if _, offset := parsed.Datetime.Zone(); offset != 2*60*60 {
+		t.Errorf("expected the timezone offset to be kept but got %d", offset)
+	}
+
+	// not base64, a single part, an invalid ID and an invalid time
+	invalidCursors := []string{"not base64!", "MTIz", "eAoyMDIwLTA4LTAxVDEyOjAwOjAwWgp0b3BpYw", "MQp5ZXN0ZXJkYXkKdG9waWM"}
+	for _, invalid := range invalidCursors {
+		if _, err := locationhistory.ParseCursor(invalid); err == nil {
+			t.Errorf("expected an error for cursor '%s'", invalid)
+		}
+	}
+}
+
+func TestCircleBoundingBoxes(t *testing.T) {
+	boxes := locationhistory.Circle{Latitude: 49, Longitude: 8, Radius: 1000}.BoundingBoxes()
+	if len(boxes) != 1 || boxes[0].MinLongitude > 7.995 || boxes[0].MaxLongitude < 8.005 ||
+		boxes[0].MinLatitude > 48.995 || boxes[0].MaxLatitude < 49.005 || boxes[0].MaxLongitude-boxes[0].MinLongitude > 0.1 {
+		t.Errorf("unexpected bounding boxes %v", boxes)
+	}
+
+	boxes = locationhistory.Circle{Latitude: 90, Longitude: 8, Radius: 1000}.BoundingBoxes()
+	if len(boxes) != 1 || boxes[0].MinLongitude != -180 || boxes[0].MaxLongitude != 180 || boxes[0].MaxLatitude != 90 {
+		t.Errorf("expected all longitudes at the pole but got %v", boxes)
+	}
+
+	for _, longitude := range []float64{179.999, -179.999} {
+		boxes = locationhistory.Circle{Latitude: 0, Longitude: longitude, Radius: 1000}.BoundingBoxes()
+		if len(boxes) != 2 {
+			t.Fatalf("expected two bounding boxes at longitude %f but got %v", longitude, boxes)
+		}
+		east, west := boxes[0], boxes[1]
+		if east.MinLongitude > west.MinLongitude {
+			east, west = west, east
+		}
+		if east.MinLongitude != -180 || east.MaxLongitude <= -180 || east.MaxLongitude > -179.98 ||
+			west.MaxLongitude != 180 || west.MinLongitude >= 180 || west.MinLongitude < 179.98 {
+			t.Errorf("expected bounding boxes on both sides of the antimeridian but got %v", boxes)
+		}
+	}
+}
+
+func TestBoundingBoxSplit(t *testing.T) {
+	bbox := locationhistory.BoundingBox{MinLatitude: -1, MaxLatitude: 1, MinLongitude: 170, MaxLongitude: 175}
+	boxes := bbox.Split()
+	if len(boxes) != 1 || boxes[0] != bbox {
+		t.Errorf("expected the bounding box itself but got %v", boxes)
+	}
+
+	bbox.MaxLongitude = -170
+	boxes = bbox.Split()
+	if len(boxes) != 2 || boxes[0].MinLongitude != 170 || boxes[0].MaxLongitude != 180 ||
+		boxes[1].MinLongitude != -180 || boxes[1].MaxLongitude != -170 ||
+		boxes[0].MinLatitude != -1 || boxes[1].MaxLatitude != 1 {
+		t.Errorf("expected bounding boxes on both sides of the antimeridian but got %v", boxes)
+	}
+}
@@ -0,0 +1,267 @@
+package locationhistory
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Migration upgrades the database schema to its version. The statements of a migration are determined from the
+// current state of the database so databases created before the schema was versioned are upgraded as well.
+type Migration struct {
+	Version     int
+	Description string
+	statements  func(q queryer, d dialect) ([]string, error)
+}
+
+// migrations contains all migrations ordered by their version. Migrations must never be changed or removed once
+// released, schema changes always require a new migration.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create waypoints table",
+		statements: ddlStatements(`CREATE TABLE IF NOT EXISTS WAYPOINTS (ID {{id}},
+					Topic TEXT NOT NULL,
+					Latitude {{double}} NOT NULL,
+					Longitude {{double}} NOT NULL,
+					Time {{timestamp}} NOT NULL,
+					CONSTRAINT all_unique UNIQUE (Topic, Latitude, Longitude, Time))`),
+	},
+	{
+		Version:     2,
+		Description: "Add optional location fields to waypoints",
+		statements:  addMissingColumns("WAYPOINTS", optionalWaypointColumns),
+	},
+	{
+		Version:     3,
+		Description: "Create transition, region, card and event tables",
+		statements:  ddlStatements(eventTables...),
+	},
+	{
+		Version:     4,
+		Description: "Create dead letter table",
+		statements:  ddlStatements(deadLetterTable),
+	},
+	{
+		Version:     5,
+		Description: "Index waypoints, transitions and events by topic and time",
+		// ID is part of the waypoint index as it is used to order waypoints with identical times
+		statements: ddlStatements(
+			`CREATE INDEX IF NOT EXISTS waypoints_topic_time ON WAYPOINTS (Topic, Time, ID)`,
+			`CREATE INDEX IF NOT EXISTS transitions_topic_time ON TRANSITIONS (Topic, Time)`,
+			`CREATE INDEX IF NOT EXISTS events_topic_time ON EVENTS (Topic, Time)`),
+	},
+	{
+		Version:     6,
+		Description: "Create spatial index of waypoints",
+		statements: func(q queryer, d dialect) ([]string, error) {
+			return d.spatialIndex(), nil
+		},
+	},
+	{
+		Version:     7,
+		Description: "Record the source of waypoints and dead letters",
+		statements: func(q queryer, d dialect) ([]string, error) {
+			statements, err := addMissingColumns("WAYPOINTS", [][2]string{{"Source", "TEXT"}})(q, d)
+			if err != nil {
+				return nil, err
+			}
+			deadLetterStatements, err := addMissingColumns("DEADLETTERS", [][2]string{{"Source", "TEXT"}})(q, d)
+			return append(statements, deadLetterStatements...), err
+		},
+	},
+	{
+		Version:     8,
+		Description: "Record the latest waypoint of each topic",
+		statements: ddlStatements(`CREATE TABLE IF NOT EXISTS LATEST_WAYPOINTS (Topic TEXT NOT NULL PRIMARY KEY,
+					Time {{timestamp}} NOT NULL,
+					WaypointID BIGINT NOT NULL)`,
+			insertLatestWaypointsSQL),
+	},
+	{
+		Version:     9,
+		Description: "Store times in UTC",
+		statements: func(q queryer, d dialect) ([]string, error) {
+			if _, ok := d.(sqliteDialect); !ok {
+				// other databases store times with time zone
+				return nil, nil
+			}
+			return sqliteTimesToUTC(), nil
+		},
+	},
+}
+
+// insertLatestWaypointsSQL records the latest waypoint of each topic
+const insertLatestWaypointsSQL = `INSERT INTO LATEST_WAYPOINTS(Topic, Time, WaypointID)
+					SELECT Topic, Time, ID FROM WAYPOINTS w
+					WHERE ID = (SELECT ID FROM WAYPOINTS WHERE Topic = w.Topic ORDER BY Time DESC, ID DESC LIMIT 1)`
+
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS SCHEMA_VERSION (Version INTEGER NOT NULL PRIMARY KEY,
+					Description TEXT NOT NULL,
+					Applied {{timestamp}} NOT NULL)`
+
+// ddlStatements returns a migration which runs the given DDL statements
+func ddlStatements(statements ...string) func(queryer, dialect) ([]string, error) {
+	return func(q queryer, d dialect) ([]string, error) {
+		result := make([]string, len(statements))
+		for i, statement := range statements {
+			result[i] = d.ddl(statement)
+		}
+		return result, nil
+	}
+}
+
+// addMissingColumns returns a migration adding the given columns to a table unless they already exist
+func addMissingColumns(table string, columns [][2]string) func(queryer, dialect) ([]string, error) {
+	return func(q queryer, d dialect) ([]string, error) {
+		existing, err := d.columns(q, table)
+		if err != nil {
+			return nil, err
+		}
+		statements := make([]string, 0)
+		for _, column := range columns {
+			if existing[strings.ToLower(column[0])] {
+				continue
+			}
+			statements = append(statements, d.ddl(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column[0], column[1])))
+		}
+		return statements, nil
+	}
+}
+
+// sqliteTimesToUTC returns the statements converting all times stored by SQLite with another offset than UTC. Times
+// which are part of a unique key are dropped if the same entry has already been stored in UTC. The latest waypoints are
+// recorded again, as they may refer to dropped waypoints.
+func sqliteTimesToUTC() []string {
+	statements := make([]string, 0)
+	for _, column := range [][2]string{{"WAYPOINTS", "Time"}, {"TRANSITIONS", "Time"}, {"REGIONS", "Created"}} {
+		statements = append(statements,
+			fmt.Sprintf(`UPDATE OR IGNORE %s SET %s = %s WHERE %s`, column[0], column[1], sqliteUTC(column[1]),
+				sqliteNotUTC(column[1])),
+			fmt.Sprintf(`DELETE FROM %s WHERE %s`, column[0], sqliteNotUTC(column[1])))
+	}
+	for _, column := range [][2]string{{"TRANSITIONS", "RegionTime"}, {"TRANSITIONS", "ReceivedTime"},
+		{"CARDS", "Updated"}, {"EVENTS", "Time"}, {"DEADLETTERS", "Received"}, {"SCHEMA_VERSION", "Applied"}} {
+		statements = append(statements, fmt.Sprintf(`UPDATE %s SET %s = %s WHERE %s`, column[0], column[1],
+			sqliteUTC(column[1]), sqliteNotUTC(column[1])))
+	}
+	return append(statements, `DELETE FROM LATEST_WAYPOINTS`, insertLatestWaypointsSQL)
+}
+
+// sqliteNotUTC returns the condition selecting times which are stored with another offset than UTC, i.e. end with an
+// offset like +02:00 that SQLite is able to convert
+func sqliteNotUTC(column string) string {
+	return fmt.Sprintf(`length(%[1]s) >= 25 AND substr(%[1]s, -6, 1) IN ('+', '-') AND substr(%[1]s, -6) <> '+00:00'
+		AND %[2]s IS NOT NULL`, column, sqliteUTCSeconds(column))
+}
+
+// sqliteUTC returns the expression converting a time stored with an offset to UTC in the format used by the driver.
+// The fractional seconds are kept as they are, as SQLite rounds them to milliseconds.
+func sqliteUTC(column string) string {
+	return fmt.Sprintf(`%[2]s || substr(%[1]s, 20, length(%[1]s) - 25) || '+00:00'`, column, sqliteUTCSeconds(column))
+}
+
+// sqliteUTCSeconds returns the expression converting a time stored with an offset to UTC without fractional seconds
+func sqliteUTCSeconds(column string) string {
+	return fmt.Sprintf(`strftime('%%Y-%%m-%%d %%H:%%M:%%S', substr(%[1]s, 1, 19) || substr(%[1]s, -6))`, column)
+}
+
+// LatestSchemaVersion returns the schema version supported by this version of the application
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the database schema, 0 if the schema is not versioned yet
+func (ldb *LocationDatabase) SchemaVersion() (int, error) {
+	columns, err := ldb.dialect.columns(ldb.db, "SCHEMA_VERSION")
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) == 0 {
+		return 0, nil
+	}
+	var version int
+	err = ldb.db.QueryRow(`SELECT COALESCE(MAX(Version), 0) FROM SCHEMA_VERSION`).Scan(&version)
+	return version, err
+}
+
+// PendingMigrations returns the migrations not yet applied to the database. An error is returned if the database
+// schema is newer than supported by this version of the application.
+func (ldb *LocationDatabase) PendingMigrations() ([]Migration, error) {
+	version, err := ldb.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > LatestSchemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than the supported version %d, upgrade the application",
+			version, LatestSchemaVersion())
+	}
+	pending := make([]Migration, 0)
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies all pending migrations in order, each one in its own transaction. The callback is called with each
+// migration and its statements before it is applied. If dryRun is set, the migrations are only passed to the callback
+// without changing the database.
+func (ldb *LocationDatabase) Migrate(dryRun bool, callback func(migration Migration, statements []string)) error {
+	pending, err := ldb.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		for _, migration := range pending {
+			// statements depending on the schema are determined before any of the pending migrations is applied
+			statements, err := migration.statements(ldb.db, ldb.dialect)
+			if err != nil {
+				return fmt.Errorf("migration %d: %v", migration.Version, err)
+			}
+			callback(migration, statements)
+		}
+		return nil
+	}
+
+	if len(pending) > 0 {
+		_, err = ldb.db.Exec(ldb.dialect.ddl(schemaVersionTable))
+		if err != nil {
+			return err
+		}
+	}
+	for _, migration := range pending {
+		err = ldb.applyMigration(migration, callback)
+		if err != nil {
+			return fmt.Errorf("migration %d: %v", migration.Version, err)
+		}
+	}
+	return nil
+}
+
+func (ldb *LocationDatabase) applyMigration(migration Migration, callback func(Migration, []string)) error {
+	tx, err := ldb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements, err := migration.statements(tx, ldb.dialect)
+	if err != nil {
+		return err
+	}
+	callback(migration, statements)
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(ldb.dialect.rebind(`INSERT INTO SCHEMA_VERSION(Version, Description, Applied) VALUES (?, ?, ?)`),
+		ldb.dialect.bind([]interface{}{migration.Version, migration.Description, time.Now()})...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,179 @@
+package locationhistory_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openMigrationTest opens the SQLite database with the given DSN both without changing its schema and via plain SQL
+func openMigrationTest(t *testing.T, dsn string) (*locationhistory.LocationDatabase, *sql.DB) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	ldb, err := locationhistory.ConnectLocationDatabase(configuration.DatabaseConfig{DriverName: "sqlite3", Dsn: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ldb.Close()
+	})
+	return ldb, db
+}
+
+func migrate(t *testing.T, ldb *locationhistory.LocationDatabase) {
+	t.Helper()
+	err := ldb.Migrate(false, func(locationhistory.Migration, []string) {})
+	if err != nil {
+		t.Fatalf("unable to migrate database: %v", err)
+	}
+}
+
+func TestMigrateTimesToUTC(t *testing.T) {
+	ldb, db := openMigrationTest(t, "file:migrationutc?mode=memory&cache=shared")
+	migrate(t, ldb)
+
+	// waypoints stored with their local offset before times were converted to UTC, the last one is a duplicate
+	for _, stored := range []string{"2020-10-25 02:30:00.5+02:00", "2020-10-25 02:10:00+01:00",
+		"2020-10-25 01:10:00+00:00", "2020-10-25 02:10:00.999999999+01:00"} {
+		_, err := db.Exec(`INSERT INTO WAYPOINTS(Topic, Latitude, Longitude, Time) VALUES ('utc', 49, 8, ?)`, stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.Exec(`DELETE FROM SCHEMA_VERSION WHERE Version = 9`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate(t, ldb)
+
+	rows, err := db.Query(`SELECT CAST(Time AS TEXT) FROM WAYPOINTS WHERE Topic = 'utc' ORDER BY Time`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	stored := make([]string, 0)
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, value)
+	}
+	expected := []string{"2020-10-25 00:30:00.5+00:00", "2020-10-25 01:10:00+00:00",
+		"2020-10-25 01:10:00.999999999+00:00"}
+	if len(stored) != len(expected) {
+		t.Fatalf("expected times %v but got %v", expected, stored)
+	}
+	for i := range expected {
+		if stored[i] != expected[i] {
+			t.Errorf("expected times %v but got %v", expected, stored)
+			break
+		}
+	}
+
+	latest, err := ldb.GetLatestWaypoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest) != 1 || !latest[0].Datetime.Equal(time.Date(2020, time.October, 25, 1, 10, 0, 999999999, time.UTC)) {
+		t.Errorf("expected the latest waypoint to be recorded again but got %v", latest)
+	}
+}
+
+func TestMigrateBaselineSchema(t *testing.T) {
+	ldb, db := openMigrationTest(t, "file:migrationbaseline?mode=memory&cache=shared")
+
+	// the schema and data of databases created before the schema was versioned
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS WAYPOINTS (ID INTEGER PRIMARY KEY AUTOINCREMENT,
+					Topic TEXT NOT NULL,
+					Latitude DOUBLE NOT NULL,
+					Longitude DOUBLE NOT NULL,
+					Time TIMESTAMP NOT NULL,
+					CONSTRAINT all_unique UNIQUE (Topic, Latitude, Longitude, Time))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := time.FixedZone("CEST", 2*60*60)
+	start := time.Date(2020, time.August, 1, 14, 0, 0, 0, zone)
+	for i := 0; i < 3; i++ {
+		_, err = db.Exec(`INSERT INTO WAYPOINTS(topic, latitude, longitude, time) VALUES (?, ?, ?, ?)`,
+			"owntracks/user/phone", 49.5, 8.5+float64(i)/10, start.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	applied := make([]int, 0)
+	err = ldb.Migrate(false, func(migration locationhistory.Migration, statements []string) {
+		applied = append(applied, migration.Version)
+	})
+	if err != nil {
+		t.Fatalf("unable to migrate database: %v", err)
+	}
+	if len(applied) != locationhistory.LatestSchemaVersion() || applied[0] != 1 {
+		t.Errorf("expected all migrations to be applied in order but got %v", applied)
+	}
+	version, err := ldb.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != locationhistory.LatestSchemaVersion() {
+		t.Errorf("expected schema version %d but got %d", locationhistory.LatestSchemaVersion(), version)
+	}
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM SCHEMA_VERSION`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != locationhistory.LatestSchemaVersion() {
+		t.Errorf("expected a SCHEMA_VERSION row per migration but got %d", count)
+	}
+
+	waypoints, err := ldb.GetWaypoints("owntracks/user/phone", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(waypoints) != 3 {
+		t.Fatalf("expected the 3 existing waypoints but got %d", len(waypoints))
+	}
+	for i, waypoint := range waypoints {
+		if waypoint.Longitude != 8.5+float64(i)/10 || !waypoint.Datetime.Equal(start.Add(time.Duration(i)*time.Minute)) ||
+			waypoint.Accuracy != nil || waypoint.Source != nil {
+			t.Errorf("existing waypoint not kept: %s", waypoint.String())
+		}
+	}
+	latest, err := ldb.GetLatestWaypoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest) != 1 || latest[0].ID != waypoints[2].ID {
+		t.Errorf("expected the last existing waypoint as latest waypoint but got %v", latest)
+	}
+	inBBox, err := ldb.WaypointsInBBox(locationhistory.BoundingBox{MinLatitude: 49, MaxLatitude: 50, MinLongitude: 8.55,
+		MaxLongitude: 9}, locationhistory.WaypointQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inBBox) != 2 {
+		t.Errorf("expected existing waypoints in the spatial index but got %d in bounding box", len(inBBox))
+	}
+
+	// migrating again changes nothing
+	err = ldb.Migrate(false, func(migration locationhistory.Migration, statements []string) {
+		t.Errorf("unexpected migration %d", migration.Version)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package locationhistory
+
+import "time"
+
+// Store provides a way to store and retrieve location data. It is implemented by LocationDatabase for all supported
+// SQL databases.
+type Store interface {
+	// AddWaypointData stores a waypoint with the given information
+	AddWaypointData(topic string, latitude float64, longitude float64, datetime time.Time) error
+	// AddWaypoint stores the given waypoint including all of its optional fields
+	AddWaypoint(waypoint Waypoint) error
+	// GetWaypoints returns the waypoints of a topic in the given time range
+	GetWaypoints(topic string, startRef *time.Time, endRef *time.Time, maxCountRef *int) ([]Waypoint, error)
+	// QueryWaypoints returns all waypoints matching the given query
+	QueryWaypoints(query WaypointQuery) ([]Waypoint, error)
+	// WaypointsInBBox returns the waypoints matching the given query inside the bounding box
+	WaypointsInBBox(bbox BoundingBox, query WaypointQuery) ([]Waypoint, error)
+	// WaypointsNear returns the waypoints matching the given query within radius meters around the position
+	WaypointsNear(latitude float64, longitude float64, radius float64, query WaypointQuery) ([]Waypoint, error)
+	// ForEachWaypoint calls fn for each waypoint matching the given query
+	ForEachWaypoint(query WaypointQuery, fn func(Waypoint) error) error
+	// GetLatestWaypoints returns the most recent waypoint of each topic ordered by topic
+	GetLatestWaypoints() ([]Waypoint, error)
+	// GetTopics returns all topics for which location data exists
+	GetTopics() ([]string, error)
+	// OpenTransaction starts a transaction for adding many waypoints at once
+	OpenTransaction() (RunningTransaction, error)
+
+	// AddTransition stores the given region transition
+	AddTransition(transition Transition) error
+	// SaveRegion stores the given region definition
+	SaveRegion(region Region) error
+	// SaveCard stores the given card
+	SaveCard(card Card) error
+	// GetCards returns the cards of all topics
+	GetCards() ([]Card, error)
+	// AddDeviceEvent stores the given device event
+	AddDeviceEvent(event DeviceEvent) error
+
+	// AddDeadLetter stores a rejected message
+	AddDeadLetter(deadLetter DeadLetter) error
+	// GetDeadLetters returns all dead letters
+	GetDeadLetters() ([]DeadLetter, error)
+	// DeleteDeadLetter removes the dead letter with the given ID
+	DeleteDeadLetter(id int) error
+	// PurgeDeadLetters removes all dead letters
+	PurgeDeadLetters() (int64, error)
+
+	// CheckWritable returns an error if waypoints currently cannot be written
+	CheckWritable() error
+
+	// Close closes the underlying database connection
+	Close() error
+}
@@ -0,0 +1,383 @@
+// Package storetest implements a conformance suite for implementations of locationhistory.Store. The same checks are
+// run against every supported database so they behave identically.
+package storetest
+
+import (
+	"fmt"
+	"time"
+
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+// TestStore checks that the given store behaves as expected. The store must be empty as its content is modified and
+// checked, so it must never be run against a production database.
+func TestStore(store locationhistory.Store) error {
+	checks := []struct {
+		name  string
+		check func(locationhistory.Store) error
+	}{
+		{"waypoints", testWaypoints},
+		{"queries", testQueries},
+		{"time zones", testTimeZones},
+		{"transactions", testTransactions},
+		{"events", testEvents},
+		{"dead letters", testDeadLetters},
+	}
+	for _, c := range checks {
+		err := c.check(store)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.name, err)
+		}
+	}
+	return nil
+}
+
+var start = time.Date(2020, time.August, 1, 12, 0, 0, 0, time.UTC)
+
+func intRef(i int) *int {
+	return &i
+}
+
+func stringRef(s string) *string {
+	return &s
+}
+
+func testWaypoints(store locationhistory.Store) error {
+	err := store.CheckWritable()
+	if err != nil {
+		return fmt.Errorf("store not writable: %v", err)
+	}
+	waypoint := locationhistory.Waypoint{
+		Topic:     "storetest/full",
+		Latitude:  49.4875,
+		Longitude: 8.466,
+		Datetime:  start,
+		Accuracy:  intRef(12),
+		Battery:   intRef(87),
+		Trigger:   stringRef("p"),
+		InRegions: []string{"home", "work"},
+	}
+	err = store.AddWaypoint(waypoint)
+	if err != nil {
+		return err
+	}
+	err = store.AddWaypoint(waypoint)
+	if err != nil {
+		return fmt.Errorf("duplicate waypoint not ignored: %v", err)
+	}
+	err = store.AddWaypointData("storetest/full", 49.5, 8.5, start.Add(time.Minute))
+	if err != nil {
+		return err
+	}
+
+	waypoints, err := store.GetWaypoints("storetest/full", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if len(waypoints) != 2 {
+		return fmt.Errorf("expected 2 waypoints but got %d", len(waypoints))
+	}
+	got := waypoints[0]
+	if got.Latitude != waypoint.Latitude || got.Longitude != waypoint.Longitude || !got.Datetime.Equal(start) {
+		return fmt.Errorf("position of waypoint not stored correctly: %s", got.String())
+	}
+	if got.Accuracy == nil || *got.Accuracy != 12 || got.Battery == nil || *got.Battery != 87 {
+		return fmt.Errorf("optional numbers of waypoint not stored correctly")
+	}
+	if got.Trigger == nil || *got.Trigger != "p" || len(got.InRegions) != 2 || got.InRegions[1] != "work" {
+		return fmt.Errorf("optional strings of waypoint not stored correctly")
+	}
+	if got.Altitude != nil || waypoints[1].Accuracy != nil {
+		return fmt.Errorf("missing optional values not stored as nil")
+	}
+
+	topics, err := store.GetTopics()
+	if err != nil {
+		return err
+	}
+	if len(topics) != 1 || topics[0] != "storetest/full" {
+		return fmt.Errorf("expected topic storetest/full but got %v", topics)
+	}
+
+	latest, err := store.GetLatestWaypoints()
+	if err != nil {
+		return err
+	}
+	if len(latest) != 1 || !latest[0].Datetime.Equal(start.Add(time.Minute)) {
+		return fmt.Errorf("expected the waypoint added last as latest waypoint")
+	}
+
+	// adding an older waypoint must not change the latest waypoint
+	err = store.AddWaypointData("storetest/full", 49.4, 8.4, start.Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	latest, err = store.GetLatestWaypoints()
+	if err != nil {
+		return err
+	}
+	if len(latest) != 1 || !latest[0].Datetime.Equal(start.Add(time.Minute)) {
+		return fmt.Errorf("older waypoint replaced the latest waypoint")
+	}
+	return nil
+}
+
+func testQueries(store locationhistory.Store) error {
+	for i := 0; i < 10; i++ {
+		err := store.AddWaypointData("storetest/query", 50+float64(i)/10, 8, start.Add(time.Duration(i)*time.Hour))
+		if err != nil {
+			return err
+		}
+	}
+
+	waypoints, err := store.QueryWaypoints(locationhistory.WaypointQuery{
+		Topics: []string{"storetest/query"},
+		From:   start.Add(2 * time.Hour),
+		To:     start.Add(5 * time.Hour),
+	})
+	if err != nil {
+		return err
+	}
+	if len(waypoints) != 4 || !waypoints[0].Datetime.Equal(start.Add(2*time.Hour)) {
+		return fmt.Errorf("expected 4 waypoints in time range but got %d", len(waypoints))
+	}
+
+	waypoints, err = store.QueryWaypoints(locationhistory.WaypointQuery{
+		Topics: []string{"storetest/query"},
+		BBox:   &locationhistory.BoundingBox{MinLatitude: 50.05, MaxLatitude: 50.25, MinLongitude: 7, MaxLongitude: 9},
+	})
+	if err != nil {
+		return err
+	}
+	if len(waypoints) != 2 {
+		return fmt.Errorf("expected 2 waypoints in bounding box but got %d", len(waypoints))
+	}
+
+	waypoints, err = store.WaypointsInBBox(locationhistory.BoundingBox{MinLatitude: 50.65, MaxLatitude: 51,
+		MinLongitude: 7.9, MaxLongitude: 8.1}, locationhistory.WaypointQuery{})
+	if err != nil {
+		return err
+	}
+	if len(waypoints) != 3 {
+		return fmt.Errorf("expected 3 waypoints in bounding box but got %d", len(waypoints))
+	}
+
+	// waypoints are 0.1 degrees or about 11 km apart
+	waypoints, err = store.WaypointsNear(50.3, 8, 12000, locationhistory.WaypointQuery{Topics: []string{"storetest/query"}})
+	if err != nil {
+		return err
+	}
+	if len(waypoints) != 3 {
+		return fmt.Errorf("expected 3 waypoints near position but got %d", len(waypoints))
+	}
+
+	// circles crossing the antimeridian include positions on both sides, which are about 56 and 167 m away
+	for _, longitude := range []float64{179.999, -179.999} {
+		err = store.AddWaypointData("storetest/antimeridian", 0, longitude, start)
+		if err != nil {
+			return err
+		}
+	}
+	waypoints, err = store.WaypointsNear(0, 179.9995, 500, locationhistory.WaypointQuery{Topics: []string{"storetest/antimeridian"}})
+	if err != nil {
+		return err
+	}
+	if len(waypoints) != 2 {
+		return fmt.Errorf("expected 2 waypoints near position at the antimeridian but got %d", len(waypoints))
+	}
+	waypoints, err = store.WaypointsInBBox(locationhistory.BoundingBox{MinLatitude: -1, MaxLatitude: 1,
+		MinLongitude: 179.99, MaxLongitude: -179.99},
+		locationhistory.WaypointQuery{Topics: []string{"storetest/antimeridian"}})
+	if err != nil {
+		return err
+	}
+	if len(waypoints) != 2 {
+		return fmt.Errorf("expected 2 waypoints in bounding box crossing the antimeridian but got %d", len(waypoints))
+	}
+
+	// page through all waypoints in descending order
+	query := locationhistory.WaypointQuery{Topics: []string{"storetest/query"}, Limit: 3, Descending: true}
+	count := 0
+	var previous *locationhistory.Waypoint
+	for {
+		page, err := store.QueryWaypoints(query)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+		for i := range page {
+			if previous != nil && !page[i].Datetime.Before(previous.Datetime) {
+				return fmt.Errorf("waypoints not in descending order")
+			}
+			previous = &page[i]
+		}
+		count += len(page)
+		cursor, err := locationhistory.ParseCursor(locationhistory.CursorOf(page[len(page)-1]).String())
+		if err != nil {
+			return err
+		}
+		query.After = cursor
+	}
+	if count != 10 {
+		return fmt.Errorf("expected 10 waypoints when paging but got %d", count)
+	}
+	return nil
+}
+
+func testTimeZones(store locationhistory.Store) error {
+	// the end of daylight saving time in central Europe, the second waypoint is stored 40 minutes after the first one
+	summer := time.FixedZone("CEST", 2*60*60)
+	winter := time.FixedZone("CET", 60*60)
+	first := time.Date(2020, time.October, 25, 2, 30, 0, 0, summer)
+	second := time.Date(2020, time.October, 25, 2, 10, 0, 0, winter)
+	for _, datetime := range []time.Time{first, second} {
+		err := store.AddWaypointData("storetest/timezones", 49, 8, datetime)
+		if err != nil {
+			return err
+		}
+	}
+
+	waypoints, err := store.QueryWaypoints(locationhistory.WaypointQuery{
+		Topics: []string{"storetest/timezones"},
+		From:   first.Add(time.Minute).UTC(),
+		To:     second.Add(time.Minute),
+	})
+	if err != nil {
+		return err
+	}
+	if len(waypoints) != 1 || !waypoints[0].Datetime.Equal(second) {
+		return fmt.Errorf("expected only the waypoint after the end of daylight saving time but got %d", len(waypoints))
+	}
+	waypoints, err = store.QueryWaypoints(locationhistory.WaypointQuery{Topics: []string{"storetest/timezones"}})
+	if err != nil {
+		return err
+	}
+	if len(waypoints) != 2 || !waypoints[0].Datetime.Equal(first) {
+		return fmt.Errorf("waypoints with different offsets not ordered by time")
+	}
+	return nil
+}
+
+func testTransactions(store locationhistory.Store) error {
+	tx, err := store.OpenTransaction()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 5; i++ {
+		err = tx.AddWaypointData("storetest/tx", 51, 9, start.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// a duplicate must not abort the transaction
+	err = tx.AddWaypointData("storetest/tx", 51, 9, start)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("duplicate waypoint not ignored: %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	err = store.ForEachWaypoint(locationhistory.WaypointQuery{Topics: []string{"storetest/tx"}}, func(locationhistory.Waypoint) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if count != 5 {
+		return fmt.Errorf("expected 5 waypoints added in transaction but got %d", count)
+	}
+	return nil
+}
+
+func testEvents(store locationhistory.Store) error {
+	transition := locationhistory.Transition{
+		Topic:        "storetest/events",
+		Event:        "enter",
+		Description:  stringRef("home"),
+		Latitude:     49,
+		Longitude:    8,
+		Datetime:     start,
+		ReceivedTime: start,
+	}
+	err := store.AddTransition(transition)
+	if err != nil {
+		return err
+	}
+	err = store.AddTransition(transition)
+	if err != nil {
+		return fmt.Errorf("duplicate transition not ignored: %v", err)
+	}
+
+	region := locationhistory.Region{Topic: "storetest/events", Created: start, Description: "home", Radius: 50}
+	err = store.SaveRegion(region)
+	if err != nil {
+		return err
+	}
+	region.Radius = 100
+	err = store.SaveRegion(region)
+	if err != nil {
+		return fmt.Errorf("region not replaced: %v", err)
+	}
+
+	for _, name := range []string{"Old Name", "New Name"} {
+		err = store.SaveCard(locationhistory.Card{Topic: "storetest/events", Name: name, Updated: start})
+		if err != nil {
+			return err
+		}
+	}
+	cards, err := store.GetCards()
+	if err != nil {
+		return err
+	}
+	if len(cards) != 1 || cards[0].Name != "New Name" {
+		return fmt.Errorf("expected a single card with the new name but got %v", cards)
+	}
+
+	return store.AddDeviceEvent(locationhistory.DeviceEvent{
+		Topic:    "storetest/events",
+		Type:     "lwt",
+		Datetime: start,
+		Payload:  `{"_type":"lwt"}`,
+	})
+}
+
+func testDeadLetters(store locationhistory.Store) error {
+	for _, reason := range []string{"first", "second", "third"} {
+		err := store.AddDeadLetter(locationhistory.DeadLetter{
+			Topic:    "storetest/deadletters",
+			Payload:  "{}",
+			Received: start,
+			Reason:   reason,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	deadLetters, err := store.GetDeadLetters()
+	if err != nil {
+		return err
+	}
+	if len(deadLetters) != 3 {
+		return fmt.Errorf("expected 3 dead letters but got %d", len(deadLetters))
+	}
+	err = store.DeleteDeadLetter(deadLetters[0].ID)
+	if err != nil {
+		return err
+	}
+	count, err := store.PurgeDeadLetters()
+	if err != nil {
+		return err
+	}
+	if count != 2 {
+		return fmt.Errorf("expected 2 purged dead letters but got %d", count)
+	}
+	return nil
+}
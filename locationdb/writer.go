@@ -0,0 +1,213 @@
+package locationhistory
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	"github.com/dfleischhacker/locationhistory-collector/metrics"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxWriteAttempts is the number of times a batch is written before giving up on a busy database
+	maxWriteAttempts = 5
+	// initialRetryDelay is the time to wait before writing a batch again, doubled with each attempt
+	initialRetryDelay = 50 * time.Millisecond
+)
+
+// errWriterClosed is returned when adding waypoints to a BatchWriter which has been closed
+var errWriterClosed = errors.New("writer closed, waypoint not stored")
+
+// BatchWriter is a Store which buffers added waypoints and writes them in batches, each one in a single transaction.
+// When the buffer is full, adding waypoints blocks until there is space again. All other methods are passed to the
+// underlying Store directly.
+type BatchWriter struct {
+	Store
+	queue chan Waypoint
+	// closing is closed when the writer stops accepting waypoints, waking up all callers waiting for space in the
+	// queue. Callers hold a read lock of sendLock while sending, so the queue is closed only after all of them returned.
+	closing   chan struct{}
+	sendLock  sync.RWMutex
+	done      chan struct{}
+	closeOnce sync.Once
+	batchSize int
+	interval  time.Duration
+}
+
+// NewBatchWriter returns a BatchWriter for the given store configured by the given config. The writer must be closed
+// to write all buffered waypoints.
+func NewBatchWriter(store Store, config configuration.DatabaseConfig) *BatchWriter {
+	writer := &BatchWriter{
+		Store:     store,
+		queue:     make(chan Waypoint, config.GetQueueSize()),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+		batchSize: config.GetBatchSize(),
+		interval:  config.FlushInterval(),
+	}
+	go writer.run()
+	return writer
+}
+
+// AddWaypointData adds a waypoint with the given information to the buffer
+func (w *BatchWriter) AddWaypointData(topic string, latitude float64, longitude float64, datetime time.Time) error {
+	return w.AddWaypoint(Waypoint{Topic: topic, Latitude: latitude, Longitude: longitude, Datetime: datetime})
+}
+
+// AddWaypoint adds the given waypoint to the buffer. If the buffer is full, it blocks until there is space again. Once
+// the writer is closed, waypoints are not accepted anymore and an error is returned instead.
+func (w *BatchWriter) AddWaypoint(waypoint Waypoint) error {
+	w.sendLock.RLock()
+	defer w.sendLock.RUnlock()
+	select {
+	case <-w.closing:
+		return errWriterClosed
+	default:
+	}
+
+	select {
+	case w.queue <- waypoint:
+		return nil
+	default:
+	}
+	log.Warnf("Write queue of %d waypoints is full, waiting for the database", cap(w.queue))
+	select {
+	case w.queue <- waypoint:
+		return nil
+	case <-w.closing:
+		return errWriterClosed
+	}
+}
+
+// QueueLength returns the number of buffered waypoints
+func (w *BatchWriter) QueueLength() int {
+	return len(w.queue)
+}
+
+// CheckWritable returns an error if the buffer is full or the underlying store does not accept writes
+func (w *BatchWriter) CheckWritable() error {
+	if len(w.queue) == cap(w.queue) {
+		return fmt.Errorf("write queue of %d waypoints is full", cap(w.queue))
+	}
+	return w.Store.CheckWritable()
+}
+
+// Flush writes all buffered waypoints and stops accepting new ones. Callers still waiting for space in the buffer get
+// an error. It returns as soon as all waypoints are written.
+func (w *BatchWriter) Flush() {
+	w.closeOnce.Do(func() {
+		close(w.closing)
+		// wait for all callers currently sending, so nothing is sent on the closed queue
+		w.sendLock.Lock()
+		close(w.queue)
+		w.sendLock.Unlock()
+	})
+	<-w.done
+}
+
+// Close writes all buffered waypoints and closes the underlying store
+func (w *BatchWriter) Close() error {
+	w.Flush()
+	return w.Store.Close()
+}
+
+// run collects waypoints until either the batch is full or the flush interval has passed
+func (w *BatchWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	batch := make([]Waypoint, 0, w.batchSize)
+	for {
+		select {
+		case waypoint, ok := <-w.queue:
+			if !ok {
+				w.write(batch)
+				return
+			}
+			batch = append(batch, waypoint)
+			if len(batch) >= w.batchSize {
+				w.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// write stores the given batch in a single transaction. Writing is retried as long as the database is busy. If the
+// batch cannot be written, its waypoints are written one by one so a single invalid waypoint does not lose the batch.
+func (w *BatchWriter) write(batch []Waypoint) {
+	if len(batch) == 0 {
+		return
+	}
+	delay := initialRetryDelay
+	for attempt := 1; ; attempt++ {
+		began := time.Now()
+		written, err := w.writeBatch(batch)
+		metrics.WriteDuration.Observe(time.Since(began).Seconds())
+		if err == nil {
+			metrics.WaypointsWritten.Add(float64(written))
+			log.Debugf("Wrote batch of %d waypoints, %d of them new", len(batch), written)
+			return
+		}
+		if isRetryable(err) && attempt < maxWriteAttempts {
+			log.Debugf("Database busy, writing batch again in %s: %v", delay, err)
+			time.Sleep(delay)
+			delay *= 2
+			continue
+		}
+		log.Warnf("Unable to write batch of %d waypoints, writing them one by one: %v", len(batch), err)
+		break
+	}
+
+	for _, waypoint := range batch {
+		written, err := w.writeBatch([]Waypoint{waypoint})
+		if err != nil {
+			metrics.WaypointsFailed.Inc()
+			log.Errorf("Unable to write waypoint %s: %v", waypoint.String(), err)
+			continue
+		}
+		metrics.WaypointsWritten.Add(float64(written))
+	}
+}
+
+// writeBatch adds all waypoints of the batch using a single transaction and prepared statement. It returns the number
+// of waypoints written, which excludes duplicates of existing waypoints.
+func (w *BatchWriter) writeBatch(batch []Waypoint) (int, error) {
+	tx, err := w.Store.OpenTransaction()
+	if err != nil {
+		return 0, err
+	}
+	for _, waypoint := range batch {
+		err = tx.add(waypoint)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return tx.added, nil
+}
+
+// isRetryable returns true if the error is caused by concurrent access and the operation may succeed if retried
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case sqlite3.Error:
+		return e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked
+	case *pq.Error:
+		// serialization_failure and deadlock_detected
+		return e.Code == "40001" || e.Code == "40P01"
+	}
+	return false
+}
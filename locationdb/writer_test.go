@@ -0,0 +1,89 @@
+package locationhistory_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBatchWriterClosedWhileAdding(t *testing.T) {
+	config := configuration.DatabaseConfig{
+		DriverName: "sqlite3",
+		Dsn:        "file:writertest?mode=memory&cache=shared",
+		BatchSize:  2,
+		QueueSize:  1,
+	}
+	store := openStore(t, config)
+	writer := locationhistory.NewBatchWriter(store, config)
+	start := time.Date(2020, time.August, 1, 12, 0, 0, 0, time.UTC)
+
+	// callers blocked on the full queue must get an error instead of sending on the closed queue
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	accepted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := writer.AddWaypointData("writertest", 49, 8, start.Add(time.Duration(i)*time.Second))
+			if err == nil {
+				lock.Lock()
+				accepted++
+				lock.Unlock()
+			}
+		}(i)
+	}
+	writer.Flush()
+	wg.Wait()
+
+	err := writer.AddWaypointData("writertest", 49, 8, start.Add(-time.Second))
+	if err == nil {
+		t.Error("expected an error when adding a waypoint after flushing")
+	}
+	waypoints, err := store.GetWaypoints("writertest", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(waypoints) != accepted {
+		t.Errorf("expected the %d accepted waypoints to be stored but got %d", accepted, len(waypoints))
+	}
+}
+
+func TestBatchWriterCountsWrittenWaypoints(t *testing.T) {
+	config := configuration.DatabaseConfig{
+		DriverName: "sqlite3",
+		Dsn:        "file:writercount?mode=memory&cache=shared",
+		BatchSize:  10,
+		QueueSize:  10,
+	}
+	store := openStore(t, config)
+	start := time.Date(2020, time.August, 1, 12, 0, 0, 0, time.UTC)
+	err := store.AddWaypointData("writercount", 49, 8, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := testutil.ToFloat64(metrics.WaypointsWritten)
+	duplicates := testutil.ToFloat64(metrics.DuplicatesIgnored)
+
+	writer := locationhistory.NewBatchWriter(store, config)
+	for i := 0; i < 3; i++ {
+		// the first waypoint already exists
+		err = writer.AddWaypointData("writercount", 49, 8, start.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Flush()
+
+	if count := testutil.ToFloat64(metrics.WaypointsWritten) - written; count != 2 {
+		t.Errorf("expected 2 waypoints counted as written but got %v", count)
+	}
+	if count := testutil.ToFloat64(metrics.DuplicatesIgnored) - duplicates; count != 1 {
+		t.Errorf("expected 1 duplicate but got %v", count)
+	}
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"os/signal"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/dfleischhacker/locationhistory-collector/export"
 	"github.com/dfleischhacker/locationhistory-collector/importer"
+	"github.com/dfleischhacker/locationhistory-collector/metrics"
+	"github.com/dfleischhacker/locationhistory-collector/owntracks"
 	"github.com/dfleischhacker/locationhistory-collector/rest"
 	"github.com/dfleischhacker/locationhistory-collector/utils"
 
@@ -21,10 +26,18 @@ import (
 	"github.com/dfleischhacker/locationhistory-collector/configuration"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// shutdownTimeout is the time given to each component to shut down
+	shutdownTimeout = 10 * time.Second
+	// exitInterrupted is the exit code if the process had to be terminated before it was shut down completely
+	exitInterrupted = 130
+)
+
 func main() {
 	var configFile string
 	var debug bool
@@ -56,8 +69,17 @@ func main() {
 		} else {
 			log.SetLevel(log.InfoLevel)
 		}
-		history = NewLocationHistory(configFile)
-		return nil
+		if c.Args().First() == "migrate" {
+			// opening the location history would already apply all pending migrations
+			return nil
+		}
+		var err error
+		history, err = NewLocationHistory(configFile)
+		return err
+	}
+
+	app.After = func(c *cli.Context) error {
+		return history.Close()
 	}
 
 	app.Commands = []cli.Command{
@@ -65,14 +87,59 @@ func main() {
 			Name:  "run",
 			Usage: "Start the history collector",
 			Action: func(c *cli.Context) error {
-				history.Run()
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go handleSignals(cancel)
+				err := history.Run(ctx)
+				// close explicitly as exit errors terminate the process before app.After is called
+				closeErr := history.Close()
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				if closeErr != nil {
+					return cli.NewExitError(fmt.Errorf("unable to close database: %v", closeErr), 1)
+				}
+				log.Info("Shut down successfully")
 				return nil
 			},
 		},
 		{
-			Name:  "export",
-			Usage: "Exports the SQLite database to JSON",
+			Name:      "export",
+			Usage:     "Exports the waypoints of all topics into the given `FILE` or to stdout",
+			ArgsUsage: "[FILE]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "topic,t",
+					Usage: "Only export waypoints of `TOPIC`",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "Only export waypoints recorded at or after `TIME`",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "Only export waypoints recorded at or before `TIME`",
+				},
+				cli.StringFlag{
+					Name:  "format,f",
+					Value: "jsonl",
+					Usage: "Write the export in `FORMAT`, one of " + strings.Join(export.Formats(), ", "),
+				},
+			},
 			Action: func(c *cli.Context) error {
+				query := locationhistory.WaypointQuery{}
+				if topic := c.String("topic"); topic != "" {
+					query.Topics = []string{topic}
+				}
+				err := parseTimeRange(c, &query)
+				if err != nil {
+					return err
+				}
+				count, err := exportWaypoints(history.locationDatabase, query, c.String("format"), c.Args().First())
+				if err != nil {
+					return err
+				}
+				log.Infof("Exported %d waypoints", count)
 				return nil
 			},
 		},
@@ -82,7 +149,7 @@ func main() {
 			Action: func(c *cli.Context) error {
 				topics, err := history.locationDatabase.GetTopics()
 				if err != nil {
-					log.Fatal(err)
+					return err
 				}
 				fmt.Printf("There is data available for the following topics:\n")
 				for _, topic := range topics {
@@ -91,27 +158,72 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "latest",
+			Usage: "List the latest position of each topic",
+			Action: func(c *cli.Context) error {
+				waypoints, err := history.locationDatabase.GetLatestWaypoints()
+				if err != nil {
+					return err
+				}
+				now := time.Now()
+				for _, waypoint := range waypoints {
+					fmt.Printf("%s\t%s\t%s ago\t%f\t%f\t%s\t%s\n", waypoint.Topic, waypoint.Datetime.Format(time.RFC3339),
+						now.Sub(waypoint.Datetime).Round(time.Second), waypoint.Latitude, waypoint.Longitude,
+						optionalValue("battery %d%%", waypoint.Battery), optionalValue("accuracy %dm", waypoint.Accuracy))
+				}
+				return nil
+			},
+		},
 		{
 			Name:      "query",
-			Usage:     "Writes all waypoints for the given `TOPIC` into the given `FILE`",
+			Usage:     "Writes the waypoints for the given `TOPIC` into the given `FILE` or to stdout if FILE is -",
 			ArgsUsage: "TOPIC FILE",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "Only return waypoints recorded at or after `TIME`, e.g. 2020-08-01, -7d or yesterday",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "Only return waypoints recorded at or before `TIME`, e.g. 2020-08-27T12:00:00Z, -1h or today",
+				},
+				cli.IntFlag{
+					Name:  "limit,l",
+					Value: 300,
+					Usage: "Return at most `COUNT` waypoints, 0 for all",
+				},
+				cli.StringFlag{
+					Name:  "order,o",
+					Value: "asc",
+					Usage: "Return the oldest (asc) or most recent (desc) waypoints first",
+				},
+				cli.StringFlag{
+					Name:  "format,f",
+					Value: "json",
+					Usage: "Write the waypoints in `FORMAT`, one of " + strings.Join(export.Formats(), ", "),
+				},
+			},
 			Action: func(c *cli.Context) error {
 				if c.NArg() != 2 {
 					return cli.NewExitError("Provide both TOPIC and FILE parameter", -2)
 				}
-				topic := c.Args().Get(0)
-				fileName := c.Args().Get(1)
-				startTime := time.Unix(0, 0)
-				endTime := time.Now()
-				maxCount := 300
-				waypoints, err := history.locationDatabase.GetWaypoints(topic, &startTime, &endTime, &maxCount)
+				query := locationhistory.WaypointQuery{
+					Topics: []string{c.Args().Get(0)},
+					Limit:  c.Int("limit"),
+				}
+				switch strings.ToLower(c.String("order")) {
+				case "asc":
+				case "desc":
+					query.Descending = true
+				default:
+					return cli.NewExitError("Order must be either asc or desc", -2)
+				}
+				err := parseTimeRange(c, &query)
 				if err != nil {
 					return err
 				}
-				data, err := json.MarshalIndent(waypoints, "", " ")
-				if err == nil {
-					err = ioutil.WriteFile(fileName, data, 0644)
-				}
+				_, err = exportWaypoints(history.locationDatabase, query, c.String("format"), c.Args().Get(1))
 				return err
 			},
 		},
@@ -119,20 +231,229 @@ func main() {
 			Name:      "import",
 			Usage:     "Imports a Google Timeline from the given export (JSON) `FILE` for the given `TOPIC`",
 			ArgsUsage: "TOPIC FILE",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "metrics-file",
+					Usage: "Write the import metrics to `FILE` for the textfile collector of the node exporter",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				if c.NArg() != 2 {
 					return cli.NewExitError("Provide both TOPIC and FILE parameter", -3)
 				}
 				topic := c.Args().Get(0)
 				fileName := c.Args().Get(1)
-				count, err := importer.ImportTimeline(&history.locationDatabase, fileName, topic)
+				began := time.Now()
+				count, err := importer.ImportTimeline(history.locationDatabase, fileName, topic)
+				if err != nil {
+					return err
+				}
+				elapsed := time.Since(began)
+				log.Infof("Imported %d waypoints in %s (%.0f waypoints/s)", count, elapsed.Round(time.Millisecond),
+					float64(count)/elapsed.Seconds())
+				if metricsFile := c.String("metrics-file"); metricsFile != "" {
+					err = metrics.WriteImportMetrics(metricsFile)
+					if err != nil {
+						return fmt.Errorf("unable to write import metrics: %v", err)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "deadletters",
+			Usage: "Manage messages which were rejected when receiving them",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List all rejected messages",
+					Action: func(c *cli.Context) error {
+						deadLetters, err := history.locationDatabase.GetDeadLetters()
+						if err != nil {
+							return err
+						}
+						for _, deadLetter := range deadLetters {
+							fmt.Printf("%d\t%s\t%s\t%s\n\t%s\n", deadLetter.ID, deadLetter.Received.Format(time.RFC3339),
+								deadLetter.Topic, deadLetter.Reason, deadLetter.Payload)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "replay",
+					Usage:     "Process the rejected messages with the given `IDS` again, or all if no ID is given",
+					ArgsUsage: "[IDS...]",
+					Action: func(c *cli.Context) error {
+						ids, err := parseIDs(c.Args())
+						if err != nil {
+							return cli.NewExitError(err, -4)
+						}
+						// waypoints are written directly instead of being buffered, so a dead letter is only deleted
+						// once its data is stored
+						router := owntracks.NewRouter(history.configuration, history.database)
+						replayed, err := router.ReplayDeadLetters(ids)
+						if err != nil {
+							return err
+						}
+						log.Infof("Replayed %d dead letters", replayed)
+						return nil
+					},
+				},
+				{
+					Name:      "purge",
+					Usage:     "Delete the rejected messages with the given `IDS`, or all if no ID is given",
+					ArgsUsage: "[IDS...]",
+					Action: func(c *cli.Context) error {
+						ids, err := parseIDs(c.Args())
+						if err != nil {
+							return cli.NewExitError(err, -4)
+						}
+						if len(ids) == 0 {
+							count, err := history.locationDatabase.PurgeDeadLetters()
+							if err != nil {
+								return err
+							}
+							log.Infof("Deleted %d dead letters", count)
+							return nil
+						}
+						for id := range ids {
+							err = history.locationDatabase.DeleteDeadLetter(id)
+							if err != nil {
+								return err
+							}
+						}
+						log.Infof("Deleted %d dead letters", len(ids))
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:      "near",
+			Usage:     "Writes the waypoints recorded near the given position into the given `FILE` or to stdout",
+			ArgsUsage: "LATITUDE LONGITUDE [FILE]",
+			Flags: []cli.Flag{
+				cli.Float64Flag{
+					Name:  "radius,r",
+					Value: 200,
+					Usage: "Return waypoints within `METERS` around the position",
+				},
+				cli.StringFlag{
+					Name:  "topic,t",
+					Usage: "Only return waypoints of `TOPIC`",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "Only return waypoints recorded at or after `TIME`",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "Only return waypoints recorded at or before `TIME`",
+				},
+				cli.StringFlag{
+					Name:  "format,f",
+					Value: "jsonl",
+					Usage: "Write the waypoints in `FORMAT`, one of " + strings.Join(export.Formats(), ", "),
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() < 2 {
+					return cli.NewExitError("Provide both LATITUDE and LONGITUDE parameter", -2)
+				}
+				latitude, err := strconv.ParseFloat(c.Args().Get(0), 64)
+				if err != nil || latitude < -90 || latitude > 90 {
+					return cli.NewExitError("LATITUDE must be a number between -90 and 90", -2)
+				}
+				longitude, err := strconv.ParseFloat(c.Args().Get(1), 64)
+				if err != nil || longitude < -180 || longitude > 180 {
+					return cli.NewExitError("LONGITUDE must be a number between -180 and 180", -2)
+				}
+				if c.Float64("radius") <= 0 {
+					return cli.NewExitError("Radius must be positive", -2)
+				}
+				query := locationhistory.WaypointQuery{
+					Near: &locationhistory.Circle{Latitude: latitude, Longitude: longitude, Radius: c.Float64("radius")},
+				}
+				if topic := c.String("topic"); topic != "" {
+					query.Topics = []string{topic}
+				}
+				err = parseTimeRange(c, &query)
 				if err != nil {
-					log.Fatal(err)
+					return err
+				}
+				count, err := exportWaypoints(history.locationDatabase, query, c.String("format"), c.Args().Get(2))
+				if err != nil {
+					return err
 				}
-				log.Infof("Imported %d waypoints", count)
+				log.Infof("Found %d waypoints", count)
 				return nil
 			},
 		},
+		{
+			Name:  "migrate",
+			Usage: "Manage the version of the database schema",
+			Subcommands: []cli.Command{
+				{
+					Name:  "status",
+					Usage: "Show the schema version and all pending migrations",
+					Action: func(c *cli.Context) error {
+						ldb, err := openDatabaseForMigration(configFile)
+						if err != nil {
+							return err
+						}
+						defer ldb.Close()
+						version, err := ldb.SchemaVersion()
+						if err != nil {
+							return err
+						}
+						fmt.Printf("Schema version %d, latest version %d\n", version, locationhistory.LatestSchemaVersion())
+						pending, err := ldb.PendingMigrations()
+						if err != nil {
+							return cli.NewExitError(err, -5)
+						}
+						for _, migration := range pending {
+							fmt.Printf("pending\t%d\t%s\n", migration.Version, migration.Description)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "up",
+					Usage: "Apply all pending migrations",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Only print the statements of the pending migrations",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						ldb, err := openDatabaseForMigration(configFile)
+						if err != nil {
+							return err
+						}
+						defer ldb.Close()
+						dryRun := c.Bool("dry-run")
+						applied := 0
+						err = ldb.Migrate(dryRun, func(migration locationhistory.Migration, statements []string) {
+							fmt.Printf("-- %d: %s\n", migration.Version, migration.Description)
+							if dryRun {
+								for _, statement := range statements {
+									fmt.Printf("%s;\n", statement)
+								}
+							}
+							applied++
+						})
+						if err != nil {
+							return cli.NewExitError(err, -5)
+						}
+						if !dryRun {
+							log.Infof("Applied %d migrations", applied)
+						}
+						return nil
+					},
+				},
+			},
+		},
 	}
 
 	sort.Sort(cli.FlagsByName(app.Flags))
@@ -145,142 +466,240 @@ func main() {
 
 }
 
-// LocationHistory contains all relevant data of the locationhistory program
-type LocationHistory struct {
-	configuration    *configuration.Configuration
-	mqttClient       mqtt.Client
-	locationDatabase locationhistory.LocationDatabase
+// openDatabaseForMigration opens the database configured in the given file without migrating it
+func openDatabaseForMigration(configFile string) (*locationhistory.LocationDatabase, error) {
+	config, err := configuration.LoadConfiguration(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return locationhistory.ConnectLocationDatabase(config.Database)
 }
 
-// OwntracksMessage represents a message sent by Owntracks
-type OwntracksMessage struct {
-	Battery              int            `json:"batt"`
-	Longitude            float64        `json:"lon"`
-	Latitude             float64        `json:"lat"`
-	Accuracy             int            `json:"acc"`
-	Pressure             float64        `json:"p"`
-	BatteryState         int            `json:"bs"`
-	VerticalAccuracy     int            `json:"vac"`
-	Trigger              string         `json:"t"`
-	InternetConnectivity string         `json:"conn"`
-	Timestamp            utils.UnixTime `json:"tst"`
-	Altitude             int            `json:"alt"`
-	TrackerID            string         `json:"tid"`
+// handleSignals calls cancel when the process is asked to terminate. A second signal terminates the process
+// immediately.
+func handleSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	received := <-signals
+	log.Infof("Received %s, shutting down", received)
+	cancel()
+	received = <-signals
+	log.Warnf("Received %s again, terminating immediately", received)
+	os.Exit(exitInterrupted)
 }
 
-// NewLocationHistory creates a new location history configured from the given configFile
-func NewLocationHistory(configFile string) LocationHistory {
-	history := LocationHistory{}
-	history.configuration = configuration.LoadConfiguration(configFile)
-
-	log.Debug("Connecting to database")
-	history.locationDatabase = locationhistory.OpenLocationDatabase(history.configuration.Database)
-	log.Debug("Connected to database")
-
-	log.Debug("Connecting to MQTT broker")
-	clientOptions := mqtt.NewClientOptions().AddBroker(history.configuration.Mqtt.URL)
-	clientOptions.SetPingTimeout(1 * time.Second)
-	clientOptions.SetAutoReconnect(true)
-	clientOptions.SetCleanSession(true)
-	clientOptions.SetKeepAlive(10 * time.Second)
-	clientOptions.SetConnectTimeout(10 * time.Second)
-
-	if history.configuration.Mqtt.Username != "" {
-		clientOptions.SetUsername(history.configuration.Mqtt.Username)
+// parseTimeRange sets the time range of the given query from the --from and --to flags
+func parseTimeRange(c *cli.Context, query *locationhistory.WaypointQuery) error {
+	var err error
+	if from := c.String("from"); from != "" {
+		query.From, err = utils.ParseTime(from)
+		if err != nil {
+			return cli.NewExitError(err, -5)
+		}
 	}
-	if history.configuration.Mqtt.Password != "" {
-		clientOptions.SetPassword(history.configuration.Mqtt.Password)
+	if to := c.String("to"); to != "" {
+		query.To, err = utils.ParseTime(to)
+		if err != nil {
+			return cli.NewExitError(err, -5)
+		}
 	}
+	return nil
+}
 
-	tlsConfig, err := NewTLSConfig()
-	if err != nil {
-		panic(err.Error())
+// exportWaypoints writes all waypoints matching the query in the given format into the given file or to stdout if the
+// file name is empty or "-". It returns the number of written waypoints.
+func exportWaypoints(ldb locationhistory.Store, query locationhistory.WaypointQuery, format string, fileName string) (int, error) {
+	out := os.Stdout
+	if fileName != "" && fileName != "-" {
+		file, err := os.Create(fileName)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		out = file
 	}
-	clientOptions.SetTLSConfig(tlsConfig)
-	history.mqttClient = mqtt.NewClient(clientOptions)
-
-	return history
-}
 
-// NewTLSConfig sets up a TLS configuration for connecting to the server
-func NewTLSConfig() (*tls.Config, error) {
-	// use certs from system
-	systemCerts, err := x509.SystemCertPool()
+	writer, err := export.NewWriter(format, out)
 	if err != nil {
-		log.Error("Unable to get system certs")
-		return nil, err
+		return 0, cli.NewExitError(err, -5)
 	}
-
-	/*pem, err := ioutil.ReadFile("/etc/ssl/cert.pem")
+	count := 0
+	err = ldb.ForEachWaypoint(query, func(waypoint locationhistory.Waypoint) error {
+		count++
+		return writer.Write(waypoint)
+	})
 	if err != nil {
-		log.Error("Unable to read pem file")
-		return nil, err
+		return count, err
 	}
+	return count, writer.Close()
+}
 
-	certpool.AppendCertsFromPEM(pem)*/
+// optionalValue formats the given value or returns "-" if it is not set
+func optionalValue(format string, value *int) string {
+	if value == nil {
+		return "-"
+	}
+	return fmt.Sprintf(format, *value)
+}
 
-	// Import client certificate/key pair, leave this in for now
-	/*cert, err := tls.LoadX509KeyPair("CLIENT CERT", "CLIENT KEY")
-	if err != nil {
-		log.Error("Unable to load key pair")
-		return nil, err
+// parseIDs converts the given arguments into a set of numeric IDs
+func parseIDs(args []string) (map[int]bool, error) {
+	ids := make(map[int]bool)
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID '%s'", arg)
+		}
+		ids[id] = true
 	}
-	*/
+	return ids, nil
+}
 
-	// Create tls.Config with desired tls properties
-	return &tls.Config{
+// LocationHistory contains all relevant data of the locationhistory program
+type LocationHistory struct {
+	configuration    *configuration.Configuration
+	brokers          []*broker
+	locationDatabase locationhistory.Store
+	// database is the store written by locationDatabase without buffering waypoints
+	database locationhistory.Store
+	router   *owntracks.Router
+}
 
-		RootCAs: systemCerts,
+// NewLocationHistory creates a new location history configured from the given configFile
+func NewLocationHistory(configFile string) (LocationHistory, error) {
+	history := LocationHistory{}
+	var err error
+	history.configuration, err = configuration.LoadConfiguration(configFile)
+	if err != nil {
+		return history, err
+	}
 
-		// Client certs for sender, add loaded certs here later
-		Certificates: []tls.Certificate{},
+	log.Debug("Connecting to database")
+	ldb, err := locationhistory.OpenLocationDatabase(history.configuration.Database)
+	if err != nil {
+		return history, err
+	}
+	// waypoints are buffered and written in batches so bursts of messages do not overload the database
+	writer := locationhistory.NewBatchWriter(ldb, history.configuration.Database)
+	metrics.WatchWriteQueue(writer.QueueLength)
+	history.locationDatabase = writer
+	history.database = ldb
+	log.Debug("Connected to database")
+	history.router = owntracks.NewRouter(history.configuration, history.locationDatabase)
 
-		PreferServerCipherSuites: true,
+	names := make(map[string]bool)
+	for _, config := range history.configuration.Mqtt {
+		if config.URL == "" {
+			log.Debug("Skipping MQTT broker without URL")
+			continue
+		}
+		if names[config.GetName()] {
+			history.Close()
+			return history, fmt.Errorf("MQTT broker '%s' configured more than once", config.GetName())
+		}
+		names[config.GetName()] = true
+		b, err := newBroker(config, history.router)
+		if err != nil {
+			history.Close()
+			return history, fmt.Errorf("MQTT broker '%s': %v", config.GetName(), err)
+		}
+		history.brokers = append(history.brokers, b)
+	}
+	if len(history.brokers) == 0 {
+		log.Info("No MQTT broker configured, only accepting data via HTTP")
+	}
 
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-		},
-	}, nil
+	return history, nil
 }
 
-// Run starts the connection to the MQTT broker and writes retrieved into the database
-func (lh *LocationHistory) Run() {
+// Run starts the connections to the MQTT brokers and the REST service and writes retrieved waypoints into the
+// database until the given context is done or the REST service fails. On return, the MQTT connections are closed and
+// the REST service is shut down. Buffered waypoints are written when the location history is closed.
+func (lh *LocationHistory) Run(ctx context.Context) error {
 	mqtt.DEBUG = log.StandardLogger()
 	mqtt.WARN = log.StandardLogger()
 	mqtt.ERROR = log.StandardLogger()
 	mqtt.CRITICAL = log.StandardLogger()
-	if token := lh.mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
-	}
-
-	log.Debug("Connected to MQTT broker")
 
-	for {
-		token := lh.mqttClient.Subscribe(lh.configuration.Mqtt.Topic, byte(1), lh.handleLocationMessage)
-		if token.Wait() && token.Error() != nil {
-			log.Errorf("Fail to subscribe... %v", token.Error())
-			time.Sleep(5 * time.Second)
-			log.Errorf("Retry to subscribe\n")
-			continue
+	checks := make([]rest.HealthCheck, len(lh.brokers))
+	for i, b := range lh.brokers {
+		checks[i] = rest.HealthCheck{Name: "mqtt " + b.config.GetName(), Check: b.check}
+	}
+	server, err := rest.NewRestService(lh.configuration, lh.locationDatabase, lh.router, checks)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	serverErrors := make(chan error, 2)
+	go func() {
+		if server.TLSConfig != nil {
+			log.Infof("Starting up HTTPS server on port %d", lh.configuration.Map.Port)
 		} else {
-			log.Info("Subscribed successfully!\n")
-			break
+			log.Infof("Starting up server on port %d", lh.configuration.Map.Port)
 		}
+		serverErrors <- rest.ListenAndServe(server)
+	}()
+	redirectServer := rest.NewRedirectServer(lh.configuration.Map)
+	if redirectServer != nil {
+		go func() {
+			log.Infof("Redirecting HTTP requests on port %d to HTTPS", lh.configuration.Map.RedirectPort)
+			serverErrors <- redirectServer.ListenAndServe()
+		}()
+	}
+
+	// brokers are connected in the background so data is accepted via HTTP and from the other brokers while a broker
+	// is not available
+	var connecting sync.WaitGroup
+	for _, b := range lh.brokers {
+		connecting.Add(1)
+		go func(b *broker) {
+			defer connecting.Done()
+			b.connect(ctx)
+		}(b)
 	}
 
-	rest.NewRestService(lh.configuration, &lh.locationDatabase)
+	select {
+	case err = <-serverErrors:
+		err = fmt.Errorf("REST service failed: %v", err)
+	case <-ctx.Done():
+	}
+
+	// stop connecting to brokers which are still not available
+	cancel()
+	connecting.Wait()
+	for _, b := range lh.brokers {
+		if b.client.IsConnected() {
+			b.disconnect()
+		}
+	}
+	if err != nil {
+		return err
+	}
 
-	select {}
+	log.Info("Shutting down REST service")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if redirectServer != nil {
+		err = redirectServer.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Warnf("Unable to shut down HTTP redirect: %v", err)
+		}
+	}
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		return fmt.Errorf("unable to shut down REST service: %v", err)
+	}
+	return nil
 }
 
-func (lh *LocationHistory) handleLocationMessage(client mqtt.Client, message mqtt.Message) {
-	log.Debugf("Got message on topic '%s': %s\n", message.Topic(), message.Payload())
-	var owntracksMessage OwntracksMessage
-	json.Unmarshal(message.Payload(), &owntracksMessage)
-	log.Infof("Received message with timestamp %s, lat %f, lon %f", owntracksMessage.Timestamp, owntracksMessage.Latitude, owntracksMessage.Longitude)
-	lh.locationDatabase.AddWaypointData(message.Topic(), owntracksMessage.Latitude, owntracksMessage.Longitude, owntracksMessage.Timestamp.Time)
+// Close writes all buffered waypoints and closes the database
+func (lh *LocationHistory) Close() error {
+	if lh.locationDatabase == nil {
+		return nil
+	}
+	log.Debug("Writing buffered waypoints and closing database")
+	err := lh.locationDatabase.Close()
+	lh.locationDatabase = nil
+	return err
 }
@@ -0,0 +1,149 @@
+// Package metrics contains the Prometheus metrics of the collector. All metrics but those of imports are registered
+// with the default registry and served by the REST service on /metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// namespace is the prefix of all metric names
+const namespace = "locationhistory"
+
+// importRegistry contains the metrics of imports. Imports run in their own process which does not serve /metrics, so
+// these metrics are written to a file by WriteImportMetrics instead.
+var importRegistry = prometheus.NewRegistry()
+
+var (
+	// MessagesReceived counts the messages received per source, i.e. MQTT broker or HTTP, and topic
+	MessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Number of messages received per source and topic.",
+	}, []string{"source", "topic"})
+
+	// LastMessage is the time of the last message received per topic
+	LastMessage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_message_timestamp_seconds",
+		Help:      "Unix time of the last message received per topic.",
+	}, []string{"topic"})
+
+	// DecodeFailures counts the messages rejected because they are malformed, implausible or cannot be decrypted
+	DecodeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decode_failures_total",
+		Help:      "Number of messages which could not be decoded, decrypted or validated per source.",
+	}, []string{"source"})
+
+	// UnknownMessages counts the messages rejected because their type is unknown
+	UnknownMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unknown_messages_total",
+		Help:      "Number of messages rejected because their type is unknown.",
+	})
+
+	// DuplicatesIgnored counts the waypoints not stored because they already exist
+	DuplicatesIgnored = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicate_waypoints_total",
+		Help:      "Number of waypoints ignored because they already exist in the database.",
+	})
+
+	// WaypointsWritten counts the waypoints written by the batch writer, duplicates of existing waypoints are counted
+	// by DuplicatesIgnored instead
+	WaypointsWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "waypoints_written_total",
+		Help:      "Number of waypoints written to the database, excluding ignored duplicates.",
+	})
+
+	// WaypointsFailed counts the waypoints the batch writer was unable to write
+	WaypointsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "waypoints_failed_total",
+		Help:      "Number of waypoints which could not be written to the database.",
+	})
+
+	// WriteDuration measures the time needed to write a batch of waypoints in a single transaction
+	WriteDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "database_write_duration_seconds",
+		Help:      "Time needed to write a batch of waypoints to the database.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+
+	// WaypointsImported counts the waypoints imported from files
+	WaypointsImported = promauto.With(importRegistry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "waypoints_imported_total",
+		Help:      "Number of waypoints imported from files per format.",
+	}, []string{"format"})
+
+	// ImportDuration is the time needed to import a file
+	ImportDuration = promauto.With(importRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "import_duration_seconds",
+		Help:      "Time needed to import the last file per format.",
+	}, []string{"format"})
+
+	// LastImport is the time the last import finished
+	LastImport = promauto.With(importRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_import_timestamp_seconds",
+		Help:      "Unix time the last import finished per format.",
+	}, []string{"format"})
+
+	// HTTPRequests counts the requests served by the REST service per route, method and status code
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests per route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	// HTTPRequestDuration measures the time needed to serve requests per route
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time needed to serve HTTP requests per route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+
+	// LiveClients is the number of clients currently receiving live positions
+	LiveClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "live_clients",
+		Help:      "Number of clients receiving live positions per transport.",
+	}, []string{"transport"})
+
+	// LiveClientsDropped counts the clients disconnected because they did not keep up with the live positions
+	LiveClientsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "live_clients_dropped_total",
+		Help:      "Number of live clients disconnected because they were too slow.",
+	})
+
+	// MqttConnected is 1 while connected to the broker and 0 otherwise
+	MqttConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mqtt_connected",
+		Help:      "Whether the collector is connected to the MQTT broker.",
+	}, []string{"broker"})
+)
+
+// WatchWriteQueue exports the number of waypoints waiting to be written as returned by the given function
+func WatchWriteQueue(length func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "write_queue_length",
+		Help:      "Number of waypoints waiting to be written to the database.",
+	}, func() float64 {
+		return float64(length())
+	})
+}
+
+// WriteImportMetrics writes the metrics of imports to the given file in the text format read by the textfile
+// collector of the Prometheus node exporter
+func WriteImportMetrics(fileName string) error {
+	return prometheus.WriteToTextfile(fileName, importRegistry)
+}
@@ -0,0 +1,43 @@
+package owntracks
+
+import (
+	"encoding/base64"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	keySize   = 32
+	nonceSize = 24
+)
+
+// EncryptedMessage wraps a payload encrypted by OwnTracks using libsodium's secretbox
+type EncryptedMessage struct {
+	Data string `json:"data"`
+}
+
+// decrypt returns the plaintext of the given message. OwnTracks prepends the nonce to the ciphertext and uses the
+// secret as key, padded with zeros or truncated to the key size.
+func (msg *EncryptedMessage) decrypt(secret string) ([]byte, error) {
+	if secret == "" {
+		return nil, reject("received encrypted message but no secret key is configured")
+	}
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		return nil, reject("encrypted data is not valid base64: %v", err)
+	}
+	if len(data) < nonceSize+secretbox.Overhead {
+		return nil, reject("encrypted data is too short")
+	}
+
+	var key [keySize]byte
+	copy(key[:], secret)
+	var nonce [nonceSize]byte
+	copy(nonce[:], data[:nonceSize])
+
+	plaintext, ok := secretbox.Open(nil, data[nonceSize:], &nonce, &key)
+	if !ok {
+		return nil, reject("decryption failed, the secret key is probably wrong")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,52 @@
+package owntracks
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// encrypt encrypts the plaintext the way OwnTracks does
+func encrypt(t *testing.T, secret string, plaintext string) *EncryptedMessage {
+	t.Helper()
+	var key [keySize]byte
+	copy(key[:], secret)
+	var nonce [nonceSize]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := secretbox.Seal(nonce[:], []byte(plaintext), &nonce, &key)
+	return &EncryptedMessage{Data: base64.StdEncoding.EncodeToString(data)}
+}
+
+func TestDecrypt(t *testing.T) {
+	payload := `{"_type":"location","lat":49.5,"lon":8.5,"tst":1596283200}`
+	msg := encrypt(t, "secret", payload)
+	plaintext, err := msg.decrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != payload {
+		t.Errorf("expected '%s' but got '%s'", payload, plaintext)
+	}
+
+	rejected := []struct {
+		name   string
+		msg    *EncryptedMessage
+		secret string
+	}{
+		{"wrong key", msg, "other"},
+		{"no key", msg, ""},
+		{"invalid base64", &EncryptedMessage{Data: "not base64!"}, "secret"},
+		{"too short", &EncryptedMessage{Data: base64.StdEncoding.EncodeToString(make([]byte, nonceSize))}, "secret"},
+	}
+	for _, test := range rejected {
+		_, err := test.msg.decrypt(test.secret)
+		if _, ok := err.(*RejectionError); !ok {
+			t.Errorf("%s: expected a rejection but got %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package owntracks
+
+import (
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/utils"
+)
+
+// Message contains the fields shared by all OwnTracks messages. It is used to determine the type of a message before
+// decoding it completely.
+type Message struct {
+	Type string `json:"_type"`
+}
+
+// LocationMessage represents a location message sent by Owntracks
+type LocationMessage struct {
+	Type                 string         `json:"_type"`
+	Topic                string         `json:"topic,omitempty"`
+	Battery              *int           `json:"batt,omitempty"`
+	Longitude            float64        `json:"lon"`
+	Latitude             float64        `json:"lat"`
+	Accuracy             *int           `json:"acc,omitempty"`
+	Pressure             *float64       `json:"p,omitempty"`
+	BatteryState         *int           `json:"bs,omitempty"`
+	VerticalAccuracy     *int           `json:"vac,omitempty"`
+	Trigger              *string        `json:"t,omitempty"`
+	InternetConnectivity *string        `json:"conn,omitempty"`
+	Timestamp            utils.UnixTime `json:"tst"`
+	Altitude             *int           `json:"alt,omitempty"`
+	TrackerID            *string        `json:"tid,omitempty"`
+	Velocity             *int           `json:"vel,omitempty"`
+	Course               *int           `json:"cog,omitempty"`
+	SSID                 *string        `json:"SSID,omitempty"`
+	BSSID                *string        `json:"BSSID,omitempty"`
+	InRegions            []string       `json:"inregions,omitempty"`
+}
+
+// TransitionMessage is sent by Owntracks when a device enters or leaves a region
+type TransitionMessage struct {
+	Event       string          `json:"event"`
+	Description *string         `json:"desc,omitempty"`
+	RegionID    *string         `json:"rid,omitempty"`
+	Latitude    float64         `json:"lat"`
+	Longitude   float64         `json:"lon"`
+	Accuracy    *int            `json:"acc,omitempty"`
+	Trigger     *string         `json:"t,omitempty"`
+	TrackerID   *string         `json:"tid,omitempty"`
+	Timestamp   utils.UnixTime  `json:"tst"`
+	RegionTime  *utils.UnixTime `json:"wtst,omitempty"`
+}
+
+// RegionMessage describes a region monitored by a device. Owntracks calls these messages waypoints.
+type RegionMessage struct {
+	Description string         `json:"desc"`
+	RegionID    *string        `json:"rid,omitempty"`
+	Latitude    float64        `json:"lat"`
+	Longitude   float64        `json:"lon"`
+	Radius      int            `json:"rad"`
+	Timestamp   utils.UnixTime `json:"tst"`
+	UUID        *string        `json:"uuid,omitempty"`
+	Major       *int           `json:"major,omitempty"`
+	Minor       *int           `json:"minor,omitempty"`
+}
+
+// RegionsMessage contains all regions monitored by a device
+type RegionsMessage struct {
+	Regions []RegionMessage `json:"waypoints"`
+}
+
+// CardMessage contains the name and avatar of the user of a device
+type CardMessage struct {
+	Type      string  `json:"_type"`
+	Topic     string  `json:"topic,omitempty"`
+	Name      string  `json:"name"`
+	Face      *string `json:"face,omitempty"`
+	TrackerID *string `json:"tid,omitempty"`
+}
+
+// TimestampMessage is used for all messages which are only stored as device events and of which only the timestamp is
+// of interest
+type TimestampMessage struct {
+	Timestamp *utils.UnixTime `json:"tst,omitempty"`
+}
+
+// NewLocationMessage creates a location message for sending the given waypoint to OwnTracks clients
+func NewLocationMessage(waypoint locationhistory.Waypoint) LocationMessage {
+	return LocationMessage{
+		Type:                 "location",
+		Topic:                waypoint.Topic,
+		Latitude:             waypoint.Latitude,
+		Longitude:            waypoint.Longitude,
+		Timestamp:            utils.UnixTime{Time: waypoint.Datetime},
+		Accuracy:             waypoint.Accuracy,
+		Altitude:             waypoint.Altitude,
+		VerticalAccuracy:     waypoint.VerticalAccuracy,
+		Velocity:             waypoint.Velocity,
+		Course:               waypoint.Course,
+		Battery:              waypoint.Battery,
+		BatteryState:         waypoint.BatteryState,
+		Pressure:             waypoint.Pressure,
+		Trigger:              waypoint.Trigger,
+		InternetConnectivity: waypoint.Connectivity,
+		TrackerID:            waypoint.TrackerID,
+		SSID:                 waypoint.SSID,
+		BSSID:                waypoint.BSSID,
+		InRegions:            waypoint.InRegions,
+	}
+}
+
+// NewCardMessage creates a card message for sending the given card to OwnTracks clients
+func NewCardMessage(card locationhistory.Card) CardMessage {
+	return CardMessage{
+		Type:      "card",
+		Topic:     card.Topic,
+		Name:      card.Name,
+		Face:      card.Face,
+		TrackerID: card.TrackerID,
+	}
+}
+
+// toWaypoint converts the message into a waypoint for the given topic keeping all optional location data
+func (msg *LocationMessage) toWaypoint(topic string) locationhistory.Waypoint {
+	return locationhistory.Waypoint{
+		Topic:            topic,
+		Latitude:         msg.Latitude,
+		Longitude:        msg.Longitude,
+		Datetime:         msg.Timestamp.Time,
+		Accuracy:         msg.Accuracy,
+		Altitude:         msg.Altitude,
+		VerticalAccuracy: msg.VerticalAccuracy,
+		Velocity:         msg.Velocity,
+		Course:           msg.Course,
+		Battery:          msg.Battery,
+		BatteryState:     msg.BatteryState,
+		Pressure:         msg.Pressure,
+		Trigger:          msg.Trigger,
+		Connectivity:     msg.InternetConnectivity,
+		TrackerID:        msg.TrackerID,
+		SSID:             msg.SSID,
+		BSSID:            msg.BSSID,
+		InRegions:        msg.InRegions,
+	}
+}
+
+func (msg *TransitionMessage) toTransition(topic string) locationhistory.Transition {
+	transition := locationhistory.Transition{
+		Topic:       topic,
+		Event:       msg.Event,
+		RegionID:    msg.RegionID,
+		Description: msg.Description,
+		Latitude:    msg.Latitude,
+		Longitude:   msg.Longitude,
+		Accuracy:    msg.Accuracy,
+		Trigger:     msg.Trigger,
+		TrackerID:   msg.TrackerID,
+		Datetime:    msg.Timestamp.Time,
+	}
+	if msg.RegionTime != nil {
+		transition.RegionTime = &msg.RegionTime.Time
+	}
+	return transition
+}
+
+func (msg *RegionMessage) toRegion(topic string) locationhistory.Region {
+	return locationhistory.Region{
+		Topic:       topic,
+		Created:     msg.Timestamp.Time,
+		RegionID:    msg.RegionID,
+		Description: msg.Description,
+		Latitude:    msg.Latitude,
+		Longitude:   msg.Longitude,
+		Radius:      msg.Radius,
+		UUID:        msg.UUID,
+		Major:       msg.Major,
+		Minor:       msg.Minor,
+	}
+}
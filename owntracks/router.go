@@ -0,0 +1,316 @@
+package owntracks
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// subtopics are the suffixes OwnTracks appends to the topic of a device for messages which are not locations
+var subtopics = []string{"/event", "/info", "/waypoint", "/waypoints", "/cmd", "/step", "/status", "/dump"}
+
+// Router decodes OwnTracks messages and stores them according to their type
+type Router struct {
+	ldb     locationhistory.Store
+	config  *configuration.Configuration
+	started time.Time
+	// lastMessages contains the time of the last message received per device topic checked by the readiness endpoint
+	lastMessages map[string]time.Time
+	// lastSourceMessages contains the time of the last message received per source
+	lastSourceMessages map[string]time.Time
+	lastMessagesLock   sync.Mutex
+	// listeners are called with each received location
+	listeners []func(locationhistory.Waypoint)
+}
+
+// NewRouter returns a new router storing all messages into the given location database. Locations and transitions
+// are validated and encrypted messages decrypted according to the given configuration.
+func NewRouter(config *configuration.Configuration, ldb locationhistory.Store) *Router {
+	return &Router{ldb: ldb, config: config, started: time.Now(), lastMessages: make(map[string]time.Time),
+		lastSourceMessages: make(map[string]time.Time)}
+}
+
+// DeviceTopic returns the topic of the device which published a message on the given topic, i.e., removes any of the
+// subtopics OwnTracks uses for non-location messages
+func DeviceTopic(topic string) string {
+	for _, subtopic := range subtopics {
+		if strings.HasSuffix(topic, subtopic) {
+			return strings.TrimSuffix(topic, subtopic)
+		}
+	}
+	return topic
+}
+
+// AddListener registers a function which is called with each waypoint received in a location message once it has been
+// passed to the store. Listeners must not block and have to be added before messages are handled.
+func (r *Router) AddListener(listener func(locationhistory.Waypoint)) {
+	r.listeners = append(r.listeners, listener)
+}
+
+// Started returns the time the router was created, i.e. since when messages are received
+func (r *Router) Started() time.Time {
+	return r.started
+}
+
+// LastMessages returns the time of the last message received since the router was created for each device topic with
+// a maximum message age configured
+func (r *Router) LastMessages() map[string]time.Time {
+	return r.copyLastMessages(r.lastMessages)
+}
+
+// LastSourceMessages returns the time of the last message received per source, i.e. the name of the broker, since the
+// router was created
+func (r *Router) LastSourceMessages() map[string]time.Time {
+	return r.copyLastMessages(r.lastSourceMessages)
+}
+
+func (r *Router) copyLastMessages(messages map[string]time.Time) map[string]time.Time {
+	r.lastMessagesLock.Lock()
+	defer r.lastMessagesLock.Unlock()
+	lastMessages := make(map[string]time.Time, len(messages))
+	for key, received := range messages {
+		lastMessages[key] = received
+	}
+	return lastMessages
+}
+
+// SourceHTTP is the source of OwnTracks messages received via HTTP
+const SourceHTTP = "http"
+
+// HandleMessage decodes the given payload received on the given topic from the given source, i.e. the name of the
+// broker, and stores it depending on its type. Rejected messages are stored as dead letters.
+func (r *Router) HandleMessage(source string, topic string, payload []byte) error {
+	r.received(source, topic)
+	err := r.Dispatch(source, topic, payload)
+	if rejection, ok := err.(*RejectionError); ok {
+		r.addDeadLetter(source, topic, payload, rejection)
+	}
+	return err
+}
+
+// HandleWaypoint validates and stores a waypoint received from the given source in another format than OwnTracks
+// messages, e.g. from other tracking clients via HTTP. Rejected waypoints are stored as dead letters containing an
+// OwnTracks location message, so they can be replayed like all other dead letters.
+func (r *Router) HandleWaypoint(source string, waypoint locationhistory.Waypoint) error {
+	r.received(source, waypoint.Topic)
+	err := validatePosition(r.config.Validation, waypoint.Latitude, waypoint.Longitude, waypoint.Datetime)
+	if rejection, ok := err.(*RejectionError); ok {
+		payload, marshalErr := json.Marshal(NewLocationMessage(waypoint))
+		if marshalErr != nil {
+			return marshalErr
+		}
+		r.addDeadLetter(source, waypoint.Topic, payload, rejection)
+		return err
+	}
+	log.Infof("Received waypoint from %s with timestamp %s, lat %f, lon %f", source, waypoint.Datetime,
+		waypoint.Latitude, waypoint.Longitude)
+	return r.storeWaypoint(source, waypoint)
+}
+
+// received records that a message was received on the given topic from the given source
+func (r *Router) received(source string, topic string) {
+	metrics.MessagesReceived.WithLabelValues(source, topic).Inc()
+	metrics.LastMessage.WithLabelValues(topic).SetToCurrentTime()
+	r.lastMessagesLock.Lock()
+	// only topics checked by the readiness endpoint are tracked, so the map does not grow with every topic seen
+	if deviceTopic := DeviceTopic(topic); r.config.Health.MaxMessageAge(deviceTopic) > 0 {
+		r.lastMessages[deviceTopic] = time.Now()
+	}
+	r.lastSourceMessages[source] = time.Now()
+	r.lastMessagesLock.Unlock()
+}
+
+// addDeadLetter stores the rejected payload as dead letter
+func (r *Router) addDeadLetter(source string, topic string, payload []byte, rejection *RejectionError) {
+	metrics.DecodeFailures.WithLabelValues(source).Inc()
+	err := r.ldb.AddDeadLetter(locationhistory.DeadLetter{
+		Topic:    topic,
+		Payload:  string(payload),
+		Received: time.Now(),
+		Reason:   rejection.Reason,
+		Source:   source,
+	})
+	if err != nil {
+		log.Errorf("Unable to store rejected message on topic '%s' as dead letter: %v", topic, err)
+	}
+}
+
+// storeWaypoint stores the waypoint received from the given source and passes it to all listeners
+func (r *Router) storeWaypoint(source string, waypoint locationhistory.Waypoint) error {
+	if source != "" {
+		waypoint.Source = &source
+	}
+	err := r.ldb.AddWaypoint(waypoint)
+	if err != nil {
+		return err
+	}
+	for _, listener := range r.listeners {
+		listener(waypoint)
+	}
+	return nil
+}
+
+// ReplayDeadLetters dispatches the dead letters with the given IDs again, or all if no ID is given. Each dead letter is
+// deleted once its message has been stored, those which are still rejected are kept. The router has to write to the
+// database directly instead of buffering waypoints, as a dead letter must not be deleted before its data is stored.
+// It returns the number of dead letters replayed.
+func (r *Router) ReplayDeadLetters(ids map[int]bool) (int, error) {
+	deadLetters, err := r.ldb.GetDeadLetters()
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, deadLetter := range deadLetters {
+		if len(ids) > 0 && !ids[deadLetter.ID] {
+			continue
+		}
+		err = r.Dispatch(deadLetter.Source, deadLetter.Topic, []byte(deadLetter.Payload))
+		if err != nil {
+			log.Warnf("Dead letter %d still cannot be processed: %v", deadLetter.ID, err)
+			continue
+		}
+		err = r.ldb.DeleteDeadLetter(deadLetter.ID)
+		if err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// Dispatch decodes the given payload received on the given topic from the given source and stores it depending on
+// its type. Messages which cannot be stored because they are malformed, implausible, cannot be decrypted or are of an
+// unknown type are rejected with a RejectionError.
+func (r *Router) Dispatch(source string, topic string, payload []byte) error {
+	var message Message
+	err := decode(payload, &message)
+	if err != nil {
+		return err
+	}
+
+	deviceTopic := DeviceTopic(topic)
+	if message.Type == "encrypted" {
+		var encrypted EncryptedMessage
+		err = decode(payload, &encrypted, "data")
+		if err != nil {
+			return err
+		}
+		payload, err = encrypted.decrypt(r.config.SecretKeyForTopic(source, deviceTopic))
+		if err != nil {
+			log.Warnf("Unable to decrypt message on topic '%s': %v", topic, err)
+			return err
+		}
+		log.Debugf("Decrypted message on topic '%s': %s", topic, payload)
+		err = decode(payload, &message)
+		if err != nil {
+			return err
+		}
+		if message.Type == "encrypted" {
+			return reject("encrypted message contains another encrypted message")
+		}
+	}
+
+	validation := r.config.Validation
+	switch message.Type {
+	case "location":
+		var location LocationMessage
+		err = decode(payload, &location, "lat", "lon", "tst")
+		if err != nil {
+			return err
+		}
+		err = validatePosition(validation, location.Latitude, location.Longitude, location.Timestamp.Time)
+		if err != nil {
+			return err
+		}
+		log.Infof("Received location with timestamp %s, lat %f, lon %f", location.Timestamp, location.Latitude, location.Longitude)
+		return r.storeWaypoint(source, location.toWaypoint(deviceTopic))
+	case "transition":
+		var transition TransitionMessage
+		err = decode(payload, &transition, "event", "lat", "lon", "tst")
+		if err != nil {
+			return err
+		}
+		err = validatePosition(validation, transition.Latitude, transition.Longitude, transition.Timestamp.Time)
+		if err != nil {
+			return err
+		}
+		log.Infof("Received transition '%s' for region '%s' on topic '%s'", transition.Event, stringValue(transition.Description), deviceTopic)
+		t := transition.toTransition(deviceTopic)
+		t.ReceivedTime = time.Now()
+		return r.ldb.AddTransition(t)
+	case "waypoint":
+		var region RegionMessage
+		err = decode(payload, &region)
+		if err != nil {
+			return err
+		}
+		log.Infof("Received region '%s' on topic '%s'", region.Description, deviceTopic)
+		return r.ldb.SaveRegion(region.toRegion(deviceTopic))
+	case "waypoints":
+		var regions RegionsMessage
+		err = decode(payload, &regions)
+		if err != nil {
+			return err
+		}
+		log.Infof("Received %d regions on topic '%s'", len(regions.Regions), deviceTopic)
+		for _, region := range regions.Regions {
+			err = r.ldb.SaveRegion(region.toRegion(deviceTopic))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "card":
+		var card CardMessage
+		err = decode(payload, &card)
+		if err != nil {
+			return err
+		}
+		log.Infof("Received card '%s' on topic '%s'", card.Name, deviceTopic)
+		return r.ldb.SaveCard(locationhistory.Card{
+			Topic:     deviceTopic,
+			Name:      card.Name,
+			Face:      card.Face,
+			TrackerID: card.TrackerID,
+			Updated:   time.Now(),
+		})
+	case "lwt", "status", "steps":
+		var event TimestampMessage
+		err = decode(payload, &event)
+		if err != nil {
+			return err
+		}
+		datetime := time.Now()
+		if event.Timestamp != nil {
+			datetime = event.Timestamp.Time
+		}
+		log.Infof("Received %s message on topic '%s'", message.Type, deviceTopic)
+		return r.ldb.AddDeviceEvent(locationhistory.DeviceEvent{
+			Topic:    deviceTopic,
+			Type:     message.Type,
+			Datetime: datetime,
+			Payload:  string(payload),
+		})
+	case "cmd", "request", "configuration", "dump":
+		// these are sent to or requested from devices and do not contain any data about the device itself
+		log.Debugf("Ignoring %s message on topic '%s'", message.Type, topic)
+		return nil
+	default:
+		// kept as dead letters so they can be replayed once the type is supported
+		metrics.UnknownMessages.Inc()
+		return reject("unknown message type '%s'", message.Type)
+	}
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
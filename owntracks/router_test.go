@@ -0,0 +1,172 @@
+package owntracks
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+// fakeStore records the calls of the Store methods used by the router. Calling any other method panics.
+type fakeStore struct {
+	locationhistory.Store
+	calls       []string
+	waypoints   []locationhistory.Waypoint
+	deadLetters []locationhistory.DeadLetter
+	// writeErr is returned when adding waypoints if set
+	writeErr error
+}
+
+func (s *fakeStore) AddWaypoint(waypoint locationhistory.Waypoint) error {
+	s.calls = append(s.calls, "AddWaypoint")
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	s.waypoints = append(s.waypoints, waypoint)
+	return nil
+}
+
+func (s *fakeStore) AddTransition(locationhistory.Transition) error {
+	s.calls = append(s.calls, "AddTransition")
+	return nil
+}
+
+func (s *fakeStore) SaveRegion(locationhistory.Region) error {
+	s.calls = append(s.calls, "SaveRegion")
+	return nil
+}
+
+func (s *fakeStore) SaveCard(locationhistory.Card) error {
+	s.calls = append(s.calls, "SaveCard")
+	return nil
+}
+
+func (s *fakeStore) AddDeviceEvent(locationhistory.DeviceEvent) error {
+	s.calls = append(s.calls, "AddDeviceEvent")
+	return nil
+}
+
+func (s *fakeStore) AddDeadLetter(deadLetter locationhistory.DeadLetter) error {
+	s.calls = append(s.calls, "AddDeadLetter")
+	s.deadLetters = append(s.deadLetters, deadLetter)
+	return nil
+}
+
+func (s *fakeStore) GetDeadLetters() ([]locationhistory.DeadLetter, error) {
+	return s.deadLetters, nil
+}
+
+func (s *fakeStore) DeleteDeadLetter(id int) error {
+	s.calls = append(s.calls, fmt.Sprintf("DeleteDeadLetter %d", id))
+	return nil
+}
+
+func TestHandleMessage(t *testing.T) {
+	tst := time.Now().Add(-time.Minute).Unix()
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		calls   []string
+	}{
+		{"location", "owntracks/user/phone",
+			fmt.Sprintf(`{"_type":"location","lat":49.5,"lon":8.5,"tst":%d,"acc":10}`, tst), []string{"AddWaypoint"}},
+		{"transition", "owntracks/user/phone/event",
+			fmt.Sprintf(`{"_type":"transition","event":"enter","desc":"home","lat":49.5,"lon":8.5,"tst":%d}`, tst),
+			[]string{"AddTransition"}},
+		{"waypoint", "owntracks/user/phone/waypoint",
+			fmt.Sprintf(`{"_type":"waypoint","desc":"home","lat":49.5,"lon":8.5,"rad":50,"tst":%d}`, tst),
+			[]string{"SaveRegion"}},
+		{"waypoints", "owntracks/user/phone/waypoints",
+			fmt.Sprintf(`{"_type":"waypoints","waypoints":[{"_type":"waypoint","desc":"home","lat":49.5,"lon":8.5,"tst":%d},`+
+				`{"_type":"waypoint","desc":"work","lat":49.4,"lon":8.6,"tst":%d}]}`, tst, tst),
+			[]string{"SaveRegion", "SaveRegion"}},
+		{"card", "owntracks/user/phone/info", `{"_type":"card","name":"User","tid":"us"}`, []string{"SaveCard"}},
+		{"lwt", "owntracks/user/phone", fmt.Sprintf(`{"_type":"lwt","tst":%d}`, tst), []string{"AddDeviceEvent"}},
+		{"status", "owntracks/user/phone/status", `{"_type":"status"}`, []string{"AddDeviceEvent"}},
+		{"cmd", "owntracks/user/phone/cmd", `{"_type":"cmd","action":"reportLocation"}`, nil},
+		{"unknown type", "owntracks/user/phone", `{"_type":"beacon","uuid":"1"}`, []string{"AddDeadLetter"}},
+		{"invalid location", "owntracks/user/phone", `{"_type":"location","lat":49.5}`, []string{"AddDeadLetter"}},
+		{"malformed JSON", "owntracks/user/phone", `{"_type":"location",`, []string{"AddDeadLetter"}},
+		{"null island", "owntracks/user/phone", fmt.Sprintf(`{"_type":"location","lat":0,"lon":0,"tst":%d}`, tst),
+			[]string{"AddDeadLetter"}},
+	}
+	for _, test := range tests {
+		store := &fakeStore{}
+		router := NewRouter(&configuration.Configuration{}, store)
+		err := router.HandleMessage("broker", test.topic, []byte(test.payload))
+		_, rejected := err.(*RejectionError)
+		if err != nil && !rejected {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if rejected != (len(store.deadLetters) > 0) {
+			t.Errorf("%s: expected rejected messages and only those to be kept as dead letters", test.name)
+		}
+		if fmt.Sprint(store.calls) != fmt.Sprint(test.calls) {
+			t.Errorf("%s: expected calls %v but got %v", test.name, test.calls, store.calls)
+		}
+	}
+}
+
+func TestHandleLocationMessage(t *testing.T) {
+	store := &fakeStore{}
+	router := NewRouter(&configuration.Configuration{}, store)
+	var received []locationhistory.Waypoint
+	router.AddListener(func(waypoint locationhistory.Waypoint) {
+		received = append(received, waypoint)
+	})
+	payload := `{"_type":"location","lat":49.5,"lon":8.5,"tst":1596283200,"acc":10,"batt":80}`
+	err := router.HandleMessage("broker", "owntracks/user/phone", []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.waypoints) != 1 || len(received) != 1 {
+		t.Fatalf("expected the waypoint to be stored and passed to the listener")
+	}
+	waypoint := store.waypoints[0]
+	if waypoint.Topic != "owntracks/user/phone" || waypoint.Latitude != 49.5 || waypoint.Longitude != 8.5 ||
+		waypoint.Datetime.Unix() != 1596283200 {
+		t.Errorf("waypoint not decoded correctly: %s", waypoint.String())
+	}
+	if waypoint.Accuracy == nil || *waypoint.Accuracy != 10 || waypoint.Battery == nil || *waypoint.Battery != 80 {
+		t.Error("optional fields of waypoint not decoded correctly")
+	}
+	if waypoint.Source == nil || *waypoint.Source != "broker" {
+		t.Error("expected the broker as source of the waypoint")
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	valid := `{"_type":"location","lat":49.5,"lon":8.5,"tst":1596283200}`
+	store := &fakeStore{deadLetters: []locationhistory.DeadLetter{
+		{ID: 1, Topic: "owntracks/user/phone", Payload: valid},
+		{ID: 2, Topic: "owntracks/user/phone", Payload: `{"_type":"location","lat":49.5}`},
+		{ID: 3, Topic: "owntracks/user/phone", Payload: valid},
+	}}
+	router := NewRouter(&configuration.Configuration{}, store)
+
+	// only the selected dead letter which could be stored is deleted
+	replayed, err := router.ReplayDeadLetters(map[int]bool{1: true, 2: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[AddWaypoint DeleteDeadLetter 1]"
+	if replayed != 1 || fmt.Sprint(store.calls) != expected {
+		t.Errorf("expected calls %s but got %v with %d replayed", expected, store.calls, replayed)
+	}
+
+	// dead letters are kept if their waypoint cannot be written
+	store.calls = nil
+	store.writeErr = errors.New("database is locked")
+	replayed, err = router.ReplayDeadLetters(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "[AddWaypoint AddWaypoint]"
+	if replayed != 0 || fmt.Sprint(store.calls) != expected {
+		t.Errorf("expected calls %s but got %v with %d replayed", expected, store.calls, replayed)
+	}
+}
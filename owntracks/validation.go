@@ -0,0 +1,70 @@
+package owntracks
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+)
+
+// RejectionError is returned for messages which can never be stored as they are, e.g. because they are malformed or
+// contain implausible data
+type RejectionError struct {
+	Reason string
+}
+
+func (e *RejectionError) Error() string {
+	return e.Reason
+}
+
+func reject(format string, args ...interface{}) error {
+	return &RejectionError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// decode unmarshals the payload into the given message, rejecting it if it is not valid JSON or if any of the given
+// required fields is missing
+func decode(payload []byte, message interface{}, requiredFields ...string) error {
+	if len(requiredFields) > 0 {
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal(payload, &fields)
+		if err != nil {
+			return reject("invalid JSON: %v", err)
+		}
+		for _, field := range requiredFields {
+			value, ok := fields[field]
+			if !ok || string(value) == "null" {
+				return reject("required field '%s' is missing", field)
+			}
+		}
+	}
+	err := json.Unmarshal(payload, message)
+	if err != nil {
+		return reject("invalid JSON: %v", err)
+	}
+	return nil
+}
+
+// validatePosition checks that the given position and timestamp are plausible according to the given configuration
+func validatePosition(config configuration.ValidationConfig, latitude float64, longitude float64, timestamp time.Time) error {
+	if latitude < -90 || latitude > 90 {
+		return reject("latitude %f out of range", latitude)
+	}
+	if longitude < -180 || longitude > 180 {
+		return reject("longitude %f out of range", longitude)
+	}
+	if !config.AllowNullIsland && latitude == 0 && longitude == 0 {
+		return reject("position is exactly at latitude and longitude 0")
+	}
+	now := time.Now()
+	if maxFuture := config.MaxFuture(); maxFuture > 0 && timestamp.After(now.Add(maxFuture)) {
+		return reject("timestamp %s lies more than %s in the future", timestamp, maxFuture)
+	}
+	if maxAge := config.MaxAge(); maxAge > 0 && timestamp.Before(now.Add(-maxAge)) {
+		return reject("timestamp %s lies more than %s in the past", timestamp, maxAge)
+	}
+	if timestamp.Unix() <= 0 {
+		return reject("timestamp %s is not after the unix epoch", timestamp)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package owntracks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+)
+
+func TestValidatePosition(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		config    configuration.ValidationConfig
+		latitude  float64
+		longitude float64
+		timestamp time.Time
+		valid     bool
+	}{
+		{"valid", configuration.ValidationConfig{}, 49.5, 8.5, now, true},
+		{"poles and antimeridian", configuration.ValidationConfig{}, -90, 180, now, true},
+		{"latitude too large", configuration.ValidationConfig{}, 90.1, 8.5, now, false},
+		{"latitude too small", configuration.ValidationConfig{}, -90.1, 8.5, now, false},
+		{"longitude too large", configuration.ValidationConfig{}, 49.5, 180.1, now, false},
+		{"longitude too small", configuration.ValidationConfig{}, 49.5, -180.1, now, false},
+		{"null island", configuration.ValidationConfig{}, 0, 0, now, false},
+		{"null island allowed", configuration.ValidationConfig{AllowNullIsland: true}, 0, 0, now, true},
+		{"equator", configuration.ValidationConfig{}, 0, 8.5, now, true},
+		{"future within default", configuration.ValidationConfig{}, 49.5, 8.5, now.Add(30 * time.Minute), true},
+		{"future beyond default", configuration.ValidationConfig{}, 49.5, 8.5, now.Add(2 * time.Hour), false},
+		{"future configured", configuration.ValidationConfig{MaxFutureSeconds: 60}, 49.5, 8.5, now.Add(2 * time.Minute), false},
+		{"future unchecked", configuration.ValidationConfig{MaxFutureSeconds: -1}, 49.5, 8.5, now.AddDate(1, 0, 0), true},
+		{"old without max age", configuration.ValidationConfig{}, 49.5, 8.5, now.AddDate(-10, 0, 0), true},
+		{"older than max age", configuration.ValidationConfig{MaxAgeDays: 30}, 49.5, 8.5, now.AddDate(0, 0, -31), false},
+		{"within max age", configuration.ValidationConfig{MaxAgeDays: 30}, 49.5, 8.5, now.AddDate(0, 0, -29), true},
+		{"unix epoch", configuration.ValidationConfig{}, 49.5, 8.5, time.Unix(0, 0), false},
+	}
+	for _, test := range tests {
+		err := validatePosition(test.config, test.latitude, test.longitude, test.timestamp)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected rejection: %v", test.name, err)
+		}
+		if !test.valid {
+			if _, ok := err.(*RejectionError); !ok {
+				t.Errorf("%s: expected a rejection but got %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		valid   bool
+	}{
+		{"complete", `{"_type":"location","lat":49.5,"lon":8.5,"tst":1596283200}`, true},
+		{"malformed JSON", `{"_type":"location","lat":49.5,`, false},
+		{"not an object", `[49.5, 8.5]`, false},
+		{"missing field", `{"_type":"location","lat":49.5,"tst":1596283200}`, false},
+		{"null field", `{"_type":"location","lat":49.5,"lon":null,"tst":1596283200}`, false},
+		{"wrong type", `{"_type":"location","lat":"north","lon":8.5,"tst":1596283200}`, false},
+	}
+	for _, test := range tests {
+		var location LocationMessage
+		err := decode([]byte(test.payload), &location, "lat", "lon", "tst")
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected rejection: %v", test.name, err)
+		}
+		if !test.valid {
+			if _, ok := err.(*RejectionError); !ok {
+				t.Errorf("%s: expected a rejection but got %v", test.name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dfleischhacker/locationhistory-collector/export"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPageSize = 1000
+	maxPageSize     = 10000
+)
+
+// waypointPage is the JSON response of the waypoints API
+type waypointPage struct {
+	Waypoints []map[string]interface{} `json:"waypoints"`
+	Next      string                   `json:"next,omitempty"`
+}
+
+// geoJSONPage is the GeoJSON response of the waypoints API. The cursor of the next page is added as foreign member.
+type geoJSONPage struct {
+	Type     string        `json:"type"`
+	Features []interface{} `json:"features"`
+	Next     string        `json:"next,omitempty"`
+}
+
+// handleTopicsAPI serves the API below /api/v1/topics/. Topics may contain slashes, so the topic is everything
+// between the prefix and the resource name. Only topics readable by the authenticated user are served.
+func handleTopicsAPI(ldb locationhistory.Store, auth *authenticator) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		path := strings.TrimPrefix(request.URL.Path, "/api/v1/topics/")
+		if !strings.HasSuffix(path, "/waypoints") {
+			http.NotFound(writer, request)
+			return
+		}
+		topic := strings.TrimSuffix(path, "/waypoints")
+		if request.Method != http.MethodGet {
+			http.Error(writer, "Only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.mayRead(request, topic) {
+			http.Error(writer, "Access to topic denied", http.StatusForbidden)
+			return
+		}
+		serveWaypoints(ldb, topic, writer, request)
+	}
+}
+
+// handleLatest serves the latest waypoint of each topic readable by the authenticated user. The topic parameter, which
+// may be repeated and contain MQTT wildcards, restricts the returned topics.
+func handleLatest(ldb locationhistory.Store, auth *authenticator) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			http.Error(writer, "Only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		filters := request.URL.Query()["topic"]
+		latest, err := ldb.GetLatestWaypoints()
+		if err != nil {
+			log.Errorf("Unable to query latest waypoints: %v", err)
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		waypoints := make([]locationhistory.Waypoint, 0, len(latest))
+		for _, waypoint := range latest {
+			if auth.mayRead(request, waypoint.Topic) && matchesAnyFilter(filters, waypoint.Topic) {
+				waypoints = append(waypoints, waypoint)
+			}
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(writer).Encode(waypoints)
+		if err != nil {
+			log.Errorf("Unable to write latest waypoints: %v", err)
+		}
+	}
+}
+
+// matchesAnyFilter returns true if the topic matches any of the given topic filters or no filters are given
+func matchesAnyFilter(filters []string, topic string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, filter := range filters {
+		if matchesFilter(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveWaypoints writes a page of the waypoints of the given topic selected by the request parameters from, to,
+// bbox, near, limit and cursor. The fields parameter restricts the returned fields. Depending on the Accept header, the
+// response is JSON or GeoJSON.
+func serveWaypoints(ldb locationhistory.Store, topic string, writer http.ResponseWriter, request *http.Request) {
+	query, err := parseWaypointQuery(request.URL.Query())
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Topics = []string{topic}
+	pageSize := query.Limit
+	// fetch one more waypoint to know whether there is another page
+	query.Limit++
+
+	waypoints, err := ldb.QueryWaypoints(query)
+	if err != nil {
+		log.Errorf("Unable to query waypoints of topic '%s': %v", topic, err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	next := ""
+	if len(waypoints) > pageSize {
+		waypoints = waypoints[:pageSize]
+		next = locationhistory.CursorOf(waypoints[pageSize-1]).String()
+		nextURL := *request.URL
+		params := nextURL.Query()
+		params.Set("cursor", next)
+		nextURL.RawQuery = params.Encode()
+		writer.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextURL.RequestURI()))
+	}
+
+	fields := parseFields(request.URL.Query().Get("fields"))
+	var response interface{}
+	if strings.Contains(request.Header.Get("Accept"), "application/geo+json") {
+		writer.Header().Set("Content-Type", "application/geo+json")
+		page := geoJSONPage{Type: "FeatureCollection", Features: make([]interface{}, 0, len(waypoints)), Next: next}
+		for _, waypoint := range waypoints {
+			feature := export.NewFeature(waypoint)
+			properties, err := selectFields(waypoint, fields)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			page.Features = append(page.Features, map[string]interface{}{
+				"type":       feature.Type,
+				"geometry":   feature.Geometry,
+				"properties": properties,
+			})
+		}
+		response = page
+	} else {
+		writer.Header().Set("Content-Type", "application/json")
+		page := waypointPage{Waypoints: make([]map[string]interface{}, 0, len(waypoints)), Next: next}
+		for _, waypoint := range waypoints {
+			selected, err := selectFields(waypoint, fields)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			page.Waypoints = append(page.Waypoints, selected)
+		}
+		response = page
+	}
+
+	err = json.NewEncoder(writer).Encode(response)
+	if err != nil {
+		log.Errorf("Unable to write waypoints: %v", err)
+	}
+}
+
+// parseWaypointQuery builds the query for the parameters from, to, bbox, near, limit, order and cursor
+func parseWaypointQuery(params url.Values) (locationhistory.WaypointQuery, error) {
+	query := locationhistory.WaypointQuery{Limit: defaultPageSize}
+	var err error
+	if from := params.Get("from"); from != "" {
+		query.From, err = utils.ParseTime(from)
+		if err != nil {
+			return query, err
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		query.To, err = utils.ParseTime(to)
+		if err != nil {
+			return query, err
+		}
+	}
+	if bbox := params.Get("bbox"); bbox != "" {
+		query.BBox, err = parseBoundingBox(bbox)
+		if err != nil {
+			return query, err
+		}
+	}
+	if near := params.Get("near"); near != "" {
+		query.Near, err = parseCircle(near)
+		if err != nil {
+			return query, err
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > maxPageSize {
+			return query, fmt.Errorf("limit must be a number between 1 and %d", maxPageSize)
+		}
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("order must be either asc or desc")
+	}
+	if cursor := params.Get("cursor"); cursor != "" {
+		query.After, err = locationhistory.ParseCursor(cursor)
+		if err != nil {
+			return query, err
+		}
+	}
+	return query, nil
+}
+
+// parseBoundingBox parses a bounding box given as minLon,minLat,maxLon,maxLat like in GeoJSON. As in GeoJSON, a minimum
+// longitude greater than the maximum longitude denotes a box crossing the antimeridian.
+func parseBoundingBox(value string) (*locationhistory.BoundingBox, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox must be given as minLon,minLat,maxLon,maxLat")
+	}
+	coordinates := make([]float64, 4)
+	for i, part := range parts {
+		coordinate, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bbox coordinate '%s'", part)
+		}
+		coordinates[i] = coordinate
+	}
+	bbox := &locationhistory.BoundingBox{
+		MinLongitude: coordinates[0],
+		MinLatitude:  coordinates[1],
+		MaxLongitude: coordinates[2],
+		MaxLatitude:  coordinates[3],
+	}
+	if bbox.MinLatitude > bbox.MaxLatitude {
+		return nil, fmt.Errorf("bbox minimum latitude must not exceed maximum latitude")
+	}
+	if bbox.MinLongitude < -180 || bbox.MinLongitude > 180 || bbox.MaxLongitude < -180 || bbox.MaxLongitude > 180 {
+		return nil, fmt.Errorf("bbox longitudes must be between -180 and 180")
+	}
+	return bbox, nil
+}
+
+// parseCircle parses a circle given as lat,lon,radius with the radius in meters
+func parseCircle(value string) (*locationhistory.Circle, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("near must be given as lat,lon,radius")
+	}
+	values := make([]float64, 3)
+	for i, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid near value '%s'", part)
+		}
+		values[i] = number
+	}
+	circle := &locationhistory.Circle{Latitude: values[0], Longitude: values[1], Radius: values[2]}
+	if circle.Latitude < -90 || circle.Latitude > 90 || circle.Longitude < -180 || circle.Longitude > 180 {
+		return nil, fmt.Errorf("near position out of range")
+	}
+	if circle.Radius <= 0 {
+		return nil, fmt.Errorf("near radius must be positive")
+	}
+	return circle, nil
+}
+
+// parseFields returns the set of requested fields or nil if all fields are requested
+func parseFields(value string) map[string]bool {
+	if value == "" {
+		return nil
+	}
+	fields := make(map[string]bool)
+	for _, field := range strings.Split(value, ",") {
+		fields[strings.TrimSpace(field)] = true
+	}
+	return fields
+}
+
+// selectFields returns the JSON representation of the waypoint restricted to the given fields
+func selectFields(waypoint locationhistory.Waypoint, fields map[string]bool) (map[string]interface{}, error) {
+	data, err := json.Marshal(waypoint)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	err = json.Unmarshal(data, &values)
+	if err != nil {
+		return nil, err
+	}
+	if fields != nil {
+		for name := range values {
+			if !fields[name] {
+				delete(values, name)
+			}
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,138 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestStore returns a store backed by an in-memory SQLite database with the given name
+func openTestStore(t *testing.T, name string) locationhistory.Store {
+	t.Helper()
+	store, err := locationhistory.OpenLocationDatabase(configuration.DatabaseConfig{
+		DriverName: "sqlite3",
+		Dsn:        "file:" + name + "?mode=memory&cache=shared",
+	})
+	if err != nil {
+		t.Fatalf("unable to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+func TestWaypointsAPIPaging(t *testing.T) {
+	store := openTestStore(t, "apipaging")
+	start := time.Date(2020, time.August, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 25; i++ {
+		// pairs of waypoints share their time, so pages have to be split by ID as well
+		err := store.AddWaypointData("owntracks/user/phone", 49+float64(i)/100, 8, start.Add(time.Duration(i/2)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := store.AddWaypointData("owntracks/user/tablet", 49, 8, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newAuthenticator(&configuration.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := handleTopicsAPI(store, auth)
+
+	for _, order := range []string{"asc", "desc"} {
+		params := url.Values{"limit": {"4"}, "order": {order}, "from": {"2020-08-01T00:00:00Z"}}
+		seen := make(map[int]bool)
+		var previous *locationhistory.Waypoint
+		pages := 0
+		for {
+			request := httptest.NewRequest("GET", "/api/v1/topics/owntracks/user/phone/waypoints?"+params.Encode(), nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("expected status 200 but got %d: %s", recorder.Code, recorder.Body.String())
+			}
+			var page struct {
+				Waypoints []locationhistory.Waypoint `json:"waypoints"`
+				Next      string                     `json:"next"`
+			}
+			err = json.NewDecoder(recorder.Body).Decode(&page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages++
+			for i := range page.Waypoints {
+				waypoint := page.Waypoints[i]
+				if seen[waypoint.ID] || waypoint.Topic != "owntracks/user/phone" {
+					t.Fatalf("%s: unexpected waypoint %s on page %d", order, waypoint.String(), pages)
+				}
+				seen[waypoint.ID] = true
+				if previous != nil && (order == "asc" && waypoint.Datetime.Before(previous.Datetime) ||
+					order == "desc" && waypoint.Datetime.After(previous.Datetime)) {
+					t.Errorf("%s: waypoints not ordered on page %d", order, pages)
+				}
+				previous = &waypoint
+			}
+			if page.Next == "" {
+				if recorder.Header().Get("Link") != "" {
+					t.Errorf("%s: unexpected link to the next page on the last page", order)
+				}
+				break
+			}
+			if len(page.Waypoints) != 4 || recorder.Header().Get("Link") == "" {
+				t.Fatalf("%s: expected a full page with a link to the next page", order)
+			}
+			params.Set("cursor", page.Next)
+		}
+		if len(seen) != 25 || pages != 7 {
+			t.Errorf("%s: expected 25 waypoints on 7 pages but got %d on %d", order, len(seen), pages)
+		}
+	}
+
+	request := httptest.NewRequest("GET", "/api/v1/topics/owntracks/user/phone/waypoints?cursor=invalid", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid cursor but got %d", recorder.Code)
+	}
+}
+
+func TestParseBoundingBox(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected *locationhistory.BoundingBox
+	}{
+		{"7.5,49,8.5,50", &locationhistory.BoundingBox{MinLongitude: 7.5, MinLatitude: 49, MaxLongitude: 8.5,
+			MaxLatitude: 50}},
+		{" 179.5, -1, -179.5, 1", &locationhistory.BoundingBox{MinLongitude: 179.5, MinLatitude: -1, MaxLongitude: -179.5,
+			MaxLatitude: 1}},
+		{"7.5,50,8.5,49", nil},
+		{"7.5,49,180.5,50", nil},
+		{"-180.5,49,8.5,50", nil},
+		{"7.5,49,8.5", nil},
+		{"7.5,49,east,50", nil},
+	}
+	for _, test := range tests {
+		bbox, err := parseBoundingBox(test.value)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error but got %v", test.value, bbox)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.value, err)
+		} else if *bbox != *test.expected {
+			t.Errorf("%s: expected %v but got %v", test.value, test.expected, bbox)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package rest
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// realm is sent to clients to request basic auth
+const realm = "locationhistory"
+
+type contextKey int
+
+// userKey is the key of the authenticated user in the request context
+const userKey contextKey = 0
+
+// authenticator authenticates requests and decides which topics the authenticated users may read
+type authenticator struct {
+	config configuration.AuthConfig
+	// enabled is true if requests have to be authenticated
+	enabled bool
+	// trustedProxies are the networks from which the trusted header is accepted
+	trustedProxies []*net.IPNet
+	// verified contains a hash of the last password verified for each user, so the expensive bcrypt comparison is not
+	// repeated for each request
+	verified     map[string][sha256.Size]byte
+	verifiedLock sync.Mutex
+}
+
+func newAuthenticator(config *configuration.Configuration) (*authenticator, error) {
+	trustedProxies, err := config.Auth.TrustedProxyNetworks()
+	if err != nil {
+		return nil, err
+	}
+	return &authenticator{
+		config:         config.Auth,
+		enabled:        config.AuthEnabled(),
+		trustedProxies: trustedProxies,
+		verified:       make(map[string][sha256.Size]byte),
+	}, nil
+}
+
+// require returns a handler which only passes authenticated requests to the given handler. The user is stored in the
+// request context. If authentication is disabled, all requests are passed.
+func (a *authenticator) require(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !a.enabled {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		user, ok := a.authenticate(request)
+		if !ok {
+			if len(a.config.Users) > 0 {
+				writer.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			}
+			http.Error(writer, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		log.Debugf("Authenticated user '%s' for %s", user, request.URL.Path)
+		handler.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), userKey, user)))
+	})
+}
+
+// authenticate returns the user authenticated by a verified client certificate, the trusted header, a bearer token
+// or basic auth in that order. The user of a client certificate is its common name. The trusted header is only
+// accepted from trusted proxies.
+func (a *authenticator) authenticate(request *http.Request) (string, bool) {
+	if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 {
+		if user := request.TLS.VerifiedChains[0][0].Subject.CommonName; user != "" {
+			return user, true
+		}
+	}
+	if a.config.TrustedHeader != "" && a.fromTrustedProxy(request) {
+		if user := request.Header.Get(a.config.TrustedHeader); user != "" {
+			return user, true
+		}
+	}
+	if authorization := request.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return a.userForToken(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	if user, password, ok := request.BasicAuth(); ok {
+		return user, a.verifyPassword(user, password)
+	}
+	return "", false
+}
+
+// fromTrustedProxy returns true if the request was sent by one of the trusted proxies
+func (a *authenticator) fromTrustedProxy(request *http.Request) bool {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// userForToken returns the user the given API token belongs to. All tokens are compared in constant time.
+func (a *authenticator) userForToken(token string) (string, bool) {
+	found := ""
+	for candidate, user := range a.config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			found = user
+		}
+	}
+	return found, found != ""
+}
+
+// verifyPassword checks the password of the given user against the configured bcrypt hash
+func (a *authenticator) verifyPassword(user string, password string) bool {
+	hash, ok := a.config.Users[user]
+	if !ok {
+		return false
+	}
+	digest := sha256.Sum256([]byte(password))
+	a.verifiedLock.Lock()
+	verified, ok := a.verified[user]
+	a.verifiedLock.Unlock()
+	if ok && subtle.ConstantTimeCompare(verified[:], digest[:]) == 1 {
+		return true
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		log.Warnf("Invalid password for user '%s'", user)
+		return false
+	}
+	a.verifiedLock.Lock()
+	a.verified[user] = digest
+	a.verifiedLock.Unlock()
+	return true
+}
+
+// mayRead returns true if the user of the request may read the given topic. If authentication is disabled, all topics
+// may be read.
+func (a *authenticator) mayRead(request *http.Request, topic string) bool {
+	return a.allowed(request, topic, a.config.ACL)
+}
+
+// mayWrite returns true if the user of the request may send data for the given topic to the ingest endpoints. If
+// authentication is disabled, all topics may be written.
+func (a *authenticator) mayWrite(request *http.Request, topic string) bool {
+	return a.allowed(request, topic, a.config.WriteACL)
+}
+
+// allowed returns true if the topic matches any of the filters the given ACL lists for the user of the request
+func (a *authenticator) allowed(request *http.Request, topic string, acl map[string][]string) bool {
+	if !a.enabled {
+		return true
+	}
+	user, ok := authenticatedUser(request)
+	if !ok {
+		return false
+	}
+	for _, filter := range acl[user] {
+		if matchesFilter(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticatedUser returns the user stored in the request context by require. It returns false if the request has
+// not been authenticated, e.g. because authentication is disabled.
+func authenticatedUser(request *http.Request) (string, bool) {
+	user, ok := request.Context().Value(userKey).(string)
+	return user, ok
+}
+
+// matchesFilter returns true if the topic matches the MQTT topic filter, i.e. + matches a single level and # any
+// number of levels at the end of the filter
+func matchesFilter(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
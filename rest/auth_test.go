@@ -0,0 +1,90 @@
+package rest
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+)
+
+func TestMatchesFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{"owntracks/user/phone", "owntracks/user/phone", true},
+		{"owntracks/user/phone", "owntracks/user/tablet", false},
+		{"owntracks/user", "owntracks/user/phone", false},
+		{"owntracks/+/phone", "owntracks/user/phone", true},
+		{"owntracks/+/phone", "owntracks/user/tablet", false},
+		{"owntracks/+", "owntracks/user/phone", false},
+		{"owntracks/#", "owntracks/user/phone", true},
+		{"owntracks/user/#", "owntracks/other/phone", false},
+		{"#", "owntracks/user/phone", true},
+	}
+	for _, test := range tests {
+		if matchesFilter(test.filter, test.topic) != test.matches {
+			t.Errorf("expected matchesFilter('%s', '%s') to return %t", test.filter, test.topic, test.matches)
+		}
+	}
+}
+
+func TestFromTrustedProxy(t *testing.T) {
+	_, network, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &authenticator{trustedProxies: []*net.IPNet{network}}
+	tests := map[string]bool{
+		"10.1.2.3:4711":    true,
+		"192.168.1.1:4711": false,
+		"[::1]:4711":       false,
+		"10.1.2.3":         false,
+	}
+	for remoteAddr, trusted := range tests {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RemoteAddr = remoteAddr
+		if a.fromTrustedProxy(request) != trusted {
+			t.Errorf("expected fromTrustedProxy to return %t for %s", trusted, remoteAddr)
+		}
+	}
+}
+
+func TestMayReadAndWrite(t *testing.T) {
+	config := &configuration.Configuration{}
+	config.Auth.Tokens = map[string]string{"token": "user"}
+	config.Auth.ACL = map[string][]string{"user": {"owntracks/user/#"}}
+	config.Auth.WriteACL = map[string][]string{"user": {"owntracks/user/phone"}}
+	a, err := newAuthenticator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest("GET", "/", nil)
+	if a.mayRead(request, "owntracks/user/phone") || a.mayWrite(request, "owntracks/user/phone") {
+		t.Error("expected unauthenticated requests not to read or write any topic")
+	}
+	request = request.WithContext(context.WithValue(request.Context(), userKey, "user"))
+	if !a.mayRead(request, "owntracks/user/phone") || a.mayRead(request, "owntracks/other/phone") {
+		t.Error("expected the user to read the topics matching the ACL only")
+	}
+	if !a.mayWrite(request, "owntracks/user/phone") || a.mayWrite(request, "owntracks/user/tablet") {
+		t.Error("expected the user to write the topics matching the write ACL only")
+	}
+}
+
+func TestOwnTracksTopic(t *testing.T) {
+	request := httptest.NewRequest("POST", "/pub", nil)
+	request.Header.Set("X-Limit-U", "other")
+	request.Header.Set("X-Limit-D", "phone")
+	if topic := ownTracksTopic("owntracks", request); topic != "owntracks/other/phone" {
+		t.Errorf("expected the user header to be used without authentication but got '%s'", topic)
+	}
+
+	request = request.WithContext(context.WithValue(request.Context(), userKey, "user"))
+	if topic := ownTracksTopic("owntracks", request); topic != "owntracks/user/phone" {
+		t.Errorf("expected the topic of the authenticated user but got '%s'", topic)
+	}
+}
@@ -0,0 +1,77 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+// gpsLoggerProtocol accepts the custom URL requests of GPSLogger for Android. The URL has to be configured to send the
+// parameters lat, lon and time (%TIME) or timestamp (%TIMESTAMP). Optionally, device (e.g. %SER), alt, acc, spd,
+// dir and batt are read.
+type gpsLoggerProtocol struct{}
+
+func (gpsLoggerProtocol) Parse(request *http.Request) (map[string][]locationhistory.Waypoint, error) {
+	err := request.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	latitude, err := formFloat(request, "lat", "latitude")
+	if err != nil {
+		return nil, err
+	}
+	longitude, err := formFloat(request, "lon", "longitude")
+	if err != nil {
+		return nil, err
+	}
+	if latitude == nil || longitude == nil {
+		return nil, errors.New("parameters lat and lon are required")
+	}
+
+	waypoint := locationhistory.Waypoint{
+		Latitude:  *latitude,
+		Longitude: *longitude,
+		Datetime:  time.Now(),
+	}
+	for _, name := range []string{"time", "timestamp"} {
+		if value := request.FormValue(name); value != "" {
+			waypoint.Datetime, err = parseTimestamp(value)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	optional := []struct {
+		names  []string
+		factor float64
+		target **int
+	}{
+		{[]string{"alt", "altitude"}, 1, &waypoint.Altitude},
+		{[]string{"acc", "accuracy"}, 1, &waypoint.Accuracy},
+		// GPSLogger sends the speed in m/s while waypoints store km/h
+		{[]string{"spd", "speed"}, 3.6, &waypoint.Velocity},
+		{[]string{"dir", "bearing"}, 1, &waypoint.Course},
+		{[]string{"batt", "battery"}, 1, &waypoint.Battery},
+	}
+	for _, field := range optional {
+		value, err := formFloat(request, field.names...)
+		if err != nil {
+			return nil, err
+		}
+		*field.target = roundedInt(value, field.factor)
+	}
+
+	device := request.FormValue("device")
+	if device == "" {
+		device = request.FormValue("ser")
+	}
+	return map[string][]locationhistory.Waypoint{device: {waypoint}}, nil
+}
+
+func (gpsLoggerProtocol) Respond(writer http.ResponseWriter) {
+	writer.WriteHeader(http.StatusOK)
+}
@@ -1,6 +1,9 @@
 package rest
 
 import (
+	"fmt"
+	"strings"
+
 	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
 	"github.com/tkrajina/gpxgo/gpx"
 )
@@ -16,6 +19,13 @@ func GenerateGpx(waypoints []locationhistory.Waypoint) *gpx.GPX {
 		point.Longitude = wp.Longitude
 		point.Latitude = wp.Latitude
 		point.Timestamp = wp.Datetime
+		if wp.Altitude != nil {
+			point.Elevation = *gpx.NewNullableFloat64(float64(*wp.Altitude))
+		}
+		if wp.Trigger != nil {
+			point.Type = *wp.Trigger
+		}
+		point.Description = describeWaypoint(wp)
 		segment.Points = append(segment.Points, point)
 	}
 	track.Segments = append(track.Segments, segment)
@@ -28,3 +38,24 @@ func GenerateGpx(waypoints []locationhistory.Waypoint) *gpx.GPX {
 func GetGpxStream(gpxDoc *gpx.GPX) ([]byte, error) {
 	return gpxDoc.ToXml(gpx.ToXmlParams{Version: "1.1", Indent: true})
 }
+
+// describeWaypoint summarizes the optional data of a waypoint for the description of a GPX point
+func describeWaypoint(wp locationhistory.Waypoint) string {
+	parts := make([]string, 0)
+	if wp.Accuracy != nil {
+		parts = append(parts, fmt.Sprintf("accuracy %d m", *wp.Accuracy))
+	}
+	if wp.Velocity != nil {
+		parts = append(parts, fmt.Sprintf("velocity %d km/h", *wp.Velocity))
+	}
+	if wp.Battery != nil {
+		parts = append(parts, fmt.Sprintf("battery %d%%", *wp.Battery))
+	}
+	if wp.SSID != nil {
+		parts = append(parts, "wifi "+*wp.SSID)
+	}
+	if len(wp.InRegions) > 0 {
+		parts = append(parts, "in "+strings.Join(wp.InRegions, ", "))
+	}
+	return strings.Join(parts, ", ")
+}
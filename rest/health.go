@@ -0,0 +1,131 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/owntracks"
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthCheck is a check which has to pass for the collector to be ready, e.g. the connection to an MQTT broker
+type HealthCheck struct {
+	// Name identifies the checked component in the response of the readiness endpoint
+	Name string
+	// Check returns an error if the component is not working
+	Check func() error
+}
+
+// checkResult is the JSON representation of a single health check
+type checkResult struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	LastMessage *time.Time `json:"lastMessage,omitempty"`
+}
+
+// healthResponse is the JSON response of the health and readiness endpoints
+type healthResponse struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks,omitempty"`
+}
+
+// handleHealth serves the liveness endpoint which only reports that the process is able to serve requests
+func handleHealth(writer http.ResponseWriter, request *http.Request) {
+	writeHealth(writer, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// handleReady serves the readiness endpoint which runs the given checks, checks that the database is writable and
+// that messages were received recently from the brokers and for the configured topics. If any check fails, the status code is 503.
+func handleReady(config *configuration.Configuration, ldb locationhistory.Store, router *owntracks.Router,
+	checks []HealthCheck) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ready := true
+		results := make([]checkResult, 0, len(checks)+1)
+		for _, check := range append([]HealthCheck{{Name: "database", Check: ldb.CheckWritable}}, checks...) {
+			result := checkResult{Name: check.Name, Status: "ok"}
+			if err := check.Check(); err != nil {
+				ready = false
+				result.Status = "failing"
+				result.Error = err.Error()
+			}
+			results = append(results, result)
+		}
+		for _, result := range messageAgeChecks(config, router) {
+			if result.Status != "ok" {
+				ready = false
+			}
+			results = append(results, result)
+		}
+
+		if !ready {
+			log.Warn("Readiness check failed")
+			writeHealth(writer, http.StatusServiceUnavailable, healthResponse{Status: "not ready", Checks: results})
+			return
+		}
+		writeHealth(writer, http.StatusOK, healthResponse{Status: "ready", Checks: results})
+	}
+}
+
+// messageAgeChecks checks whether the last message received from each MQTT broker and the last message of each
+// configured topic is older than allowed. Until a message is received, its age is measured from the start of the
+// collector.
+func messageAgeChecks(config *configuration.Configuration, router *owntracks.Router) []checkResult {
+	results := make([]checkResult, 0)
+	if maxAge := config.Health.MaxBrokerMessageAge(); maxAge > 0 {
+		lastMessages := router.LastSourceMessages()
+		for _, broker := range config.Mqtt {
+			if broker.URL == "" {
+				continue
+			}
+			results = append(results, messageAgeCheck("broker "+broker.GetName(), lastMessages[broker.GetName()],
+				maxAge, router.Started()))
+		}
+	}
+
+	topics := make([]string, 0, len(config.Health.Topics))
+	for topic := range config.Health.Topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	lastMessages := router.LastMessages()
+	for _, topic := range topics {
+		maxAge := config.Health.MaxMessageAge(topic)
+		if maxAge == 0 {
+			continue
+		}
+		results = append(results, messageAgeCheck("topic "+topic, lastMessages[topic], maxAge, router.Started()))
+	}
+	return results
+}
+
+// messageAgeCheck checks that the last message received at the given time, which is zero if no message has been
+// received since the collector was started, is not older than maxAge
+func messageAgeCheck(name string, received time.Time, maxAge time.Duration, started time.Time) checkResult {
+	result := checkResult{Name: name, Status: "ok"}
+	since := started
+	if !received.IsZero() {
+		result.LastMessage = &received
+		since = received
+	}
+	if age := time.Since(since); age > maxAge {
+		result.Status = "failing"
+		result.Error = fmt.Sprintf("no message for %s", age.Round(time.Second))
+	}
+	return result
+}
+
+func writeHealth(writer http.ResponseWriter, status int, response healthResponse) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	err := json.NewEncoder(writer).Encode(response)
+	if err != nil {
+		log.Errorf("Unable to write health status: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package rest
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/owntracks"
+	log "github.com/sirupsen/logrus"
+)
+
+// IngestProtocol converts the requests sent by a tracking client into waypoints
+type IngestProtocol interface {
+	// Parse returns the waypoints contained in the given request, grouped by the device ID sent by the client
+	Parse(request *http.Request) (map[string][]locationhistory.Waypoint, error)
+	// Respond writes the response the client expects after its data has been stored
+	Respond(writer http.ResponseWriter)
+}
+
+// ingestProtocols contains all supported protocols by the name used in the configuration
+var ingestProtocols = map[string]IngestProtocol{
+	"gpslogger": gpsLoggerProtocol{},
+	"overland":  overlandProtocol{},
+	"osmand":    osmAndProtocol{},
+}
+
+// handleIngest returns the handler accepting data for the given endpoint. Each waypoint is passed to the given router,
+// so data of all clients is validated and stored the same way. Authenticated users may only send data for the topics
+// they may write.
+func handleIngest(config *configuration.Configuration, endpoint configuration.IngestEndpointConfig, router *owntracks.Router,
+	auth *authenticator) (http.HandlerFunc, error) {
+	protocol, ok := ingestProtocols[strings.ToLower(endpoint.Protocol)]
+	if !ok {
+		return nil, fmt.Errorf("unknown ingest protocol '%s'", endpoint.Protocol)
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		request.Body = http.MaxBytesReader(writer, request.Body, maxPayloadSize)
+		devices, err := protocol.Parse(request)
+		if err != nil {
+			log.Warnf("Unable to parse %s request: %v", endpoint.Protocol, err)
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// all topics are checked first, so nothing is stored if any of them may not be written
+		topics := make(map[string]string, len(devices))
+		for device := range devices {
+			topic := endpoint.TopicForDevice(config.Ingest.GetTopicPrefix(), device)
+			if topic == "" {
+				http.Error(writer, "Unable to determine topic, no device ID sent", http.StatusBadRequest)
+				return
+			}
+			if !auth.mayWrite(request, topic) {
+				log.Warnf("Rejected %s data for topic '%s' not writable by the user", endpoint.Protocol, topic)
+				http.Error(writer, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			topics[device] = topic
+		}
+
+		for device, waypoints := range devices {
+			topic := topics[device]
+			for _, waypoint := range waypoints {
+				waypoint.Topic = topic
+				// the protocol is recorded as source so waypoints of different apps can be told apart
+				err = router.HandleWaypoint(owntracks.SourceHTTP+"/"+endpoint.Protocol, waypoint)
+				if err != nil {
+					if _, rejected := err.(*owntracks.RejectionError); !rejected {
+						log.Errorf("Unable to handle %s data for topic '%s': %v", endpoint.Protocol, topic, err)
+						http.Error(writer, err.Error(), http.StatusInternalServerError)
+						return
+					}
+					log.Warnf("Rejected %s data for topic '%s': %v", endpoint.Protocol, topic, err)
+				}
+			}
+		}
+
+		protocol.Respond(writer)
+	}, nil
+}
+
+// parseTimestamp parses unix timestamps in seconds or milliseconds as well as RFC 3339 dates
+func parseTimestamp(value string) (time.Time, error) {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if i > 1e12 {
+			return time.Unix(i/1000, (i%1000)*int64(time.Millisecond)), nil
+		}
+		return time.Unix(i, 0), nil
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(f*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// formFloat returns the value of the first of the given form parameters which is present
+func formFloat(request *http.Request, names ...string) (*float64, error) {
+	for _, name := range names {
+		value := request.FormValue(name)
+		if value == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value '%s' for parameter %s", value, name)
+		}
+		return &f, nil
+	}
+	return nil, nil
+}
+
+// roundedInt converts an optional float into an optional int, applying the given factor first
+func roundedInt(f *float64, factor float64) *int {
+	if f == nil {
+		return nil
+	}
+	i := int(math.Round(*f * factor))
+	return &i
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
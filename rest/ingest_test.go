@@ -0,0 +1,193 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/owntracks"
+)
+
+// waypointStore keeps added waypoints in memory. Calling any other method than AddWaypoint and AddDeadLetter panics.
+type waypointStore struct {
+	locationhistory.Store
+	waypoints   []locationhistory.Waypoint
+	deadLetters []locationhistory.DeadLetter
+}
+
+func (s *waypointStore) AddWaypoint(waypoint locationhistory.Waypoint) error {
+	s.waypoints = append(s.waypoints, waypoint)
+	return nil
+}
+
+func (s *waypointStore) AddDeadLetter(deadLetter locationhistory.DeadLetter) error {
+	s.deadLetters = append(s.deadLetters, deadLetter)
+	return nil
+}
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2020, time.August, 1, 12, 0, 0, 0, time.UTC)
+	for _, value := range []string{"1596283200", "1596283200000", "1596283200.0", "2020-08-01T14:00:00+02:00"} {
+		parsed, err := parseTimestamp(value)
+		if err != nil {
+			t.Errorf("unable to parse '%s': %v", value, err)
+			continue
+		}
+		if !parsed.Equal(expected) {
+			t.Errorf("expected %v for '%s' but got %v", expected, value, parsed)
+		}
+	}
+	if _, err := parseTimestamp("yesterday"); err == nil {
+		t.Error("expected an error for an invalid timestamp")
+	}
+}
+
+func TestGPSLoggerParse(t *testing.T) {
+	request := httptest.NewRequest("GET", "/gpslogger?lat=49.5&lon=8.5&time=2020-08-01T12:00:00Z&spd=10&batt=80&ser=abc", nil)
+	devices, err := gpsLoggerProtocol{}.Parse(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waypoints := devices["abc"]
+	if len(waypoints) != 1 {
+		t.Fatalf("expected a waypoint for device abc but got %v", devices)
+	}
+	waypoint := waypoints[0]
+	if waypoint.Latitude != 49.5 || waypoint.Longitude != 8.5 || waypoint.Datetime.Unix() != 1596283200 {
+		t.Errorf("position not parsed correctly: %s", waypoint.String())
+	}
+	if waypoint.Velocity == nil || *waypoint.Velocity != 36 || waypoint.Battery == nil || *waypoint.Battery != 80 {
+		t.Error("expected speed converted to km/h and battery")
+	}
+	if waypoint.Altitude != nil {
+		t.Error("expected missing altitude as nil")
+	}
+
+	for _, query := range []string{"lat=49.5", "lat=49.5&lon=east", "lat=49.5&lon=8.5&time=soon"} {
+		if _, err := (gpsLoggerProtocol{}).Parse(httptest.NewRequest("GET", "/gpslogger?"+query, nil)); err == nil {
+			t.Errorf("expected an error for '%s'", query)
+		}
+	}
+}
+
+func TestOsmAndParse(t *testing.T) {
+	request := httptest.NewRequest("POST", "/osmand", strings.NewReader("id=123&lat=49.5&lon=8.5&timestamp=1596283200&speed=10"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	devices, err := osmAndProtocol{}.Parse(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waypoints := devices["123"]
+	if len(waypoints) != 1 {
+		t.Fatalf("expected a waypoint for device 123 but got %v", devices)
+	}
+	waypoint := waypoints[0]
+	if waypoint.Latitude != 49.5 || waypoint.Longitude != 8.5 || waypoint.Datetime.Unix() != 1596283200 {
+		t.Errorf("position not parsed correctly: %s", waypoint.String())
+	}
+	if waypoint.Velocity == nil || *waypoint.Velocity != 19 {
+		t.Error("expected speed converted from knots to km/h")
+	}
+}
+
+func TestOverlandParse(t *testing.T) {
+	body := `{"locations": [{"type": "Feature",
+		"geometry": {"type": "Point", "coordinates": [8.5, 49.5]},
+		"properties": {"timestamp": "2020-08-01T12:00:00Z", "speed": -1, "course": 90, "battery_level": 0.8,
+			"horizontal_accuracy": 10, "wifi": "home", "device_id": "phone"}}]}`
+	devices, err := overlandProtocol{}.Parse(httptest.NewRequest("POST", "/overland", strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waypoints := devices["phone"]
+	if len(waypoints) != 1 {
+		t.Fatalf("expected a waypoint for device phone but got %v", devices)
+	}
+	waypoint := waypoints[0]
+	if waypoint.Latitude != 49.5 || waypoint.Longitude != 8.5 || waypoint.Datetime.Unix() != 1596283200 {
+		t.Errorf("position not parsed correctly: %s", waypoint.String())
+	}
+	if waypoint.Velocity != nil {
+		t.Error("expected unknown speed as nil")
+	}
+	if waypoint.Battery == nil || *waypoint.Battery != 80 || waypoint.Course == nil || *waypoint.Course != 90 ||
+		waypoint.Accuracy == nil || *waypoint.Accuracy != 10 || waypoint.SSID == nil || *waypoint.SSID != "home" {
+		t.Error("optional values not parsed correctly")
+	}
+
+	body = `{"locations": [{"type": "Feature", "geometry": {"type": "LineString", "coordinates": [[8.5, 49.5]]}}]}`
+	if _, err := (overlandProtocol{}).Parse(httptest.NewRequest("POST", "/overland", strings.NewReader(body))); err == nil {
+		t.Error("expected an error for a location which is not a point")
+	}
+}
+
+func TestHandleIngest(t *testing.T) {
+	config := &configuration.Configuration{}
+	config.Auth.Tokens = map[string]string{"token": "alice"}
+	config.Auth.WriteACL = map[string][]string{"alice": {"owntracks/osmand/alice", "traccar/car"}}
+	endpoint := configuration.IngestEndpointConfig{Protocol: "osmand", Path: "/osmand",
+		Devices: map[string]string{"car": "traccar/car", "bike": "traccar/bike"}}
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &waypointStore{}
+	handler, err := handleIngest(config, endpoint, owntracks.NewRouter(config, store), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(query string, token string) int {
+		request := httptest.NewRequest("POST", "/osmand?"+query, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		auth.require(handler).ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	timestamp := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	query := "lat=49.5&lon=8.5&timestamp=" + strconv.FormatInt(timestamp.UnixNano()/int64(time.Millisecond), 10)
+	if code := send("id=alice&"+query, "token"); code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", code)
+	}
+	if code := send("id=car&"+query, "token"); code != http.StatusOK {
+		t.Fatalf("expected status 200 for a mapped device but got %d", code)
+	}
+	if len(store.waypoints) != 2 {
+		t.Fatalf("expected 2 stored waypoints but got %d", len(store.waypoints))
+	}
+	waypoint := store.waypoints[0]
+	if waypoint.Topic != "owntracks/osmand/alice" || !waypoint.Datetime.Equal(timestamp) {
+		t.Errorf("expected waypoint of topic owntracks/osmand/alice at %v but got %s", timestamp, waypoint.String())
+	}
+	if waypoint.Source == nil || *waypoint.Source != "http/osmand" {
+		t.Error("expected the protocol as source of the waypoint")
+	}
+
+	// other devices, mapped or not, may not be written
+	for _, device := range []string{"bob", "bike"} {
+		if code := send("id="+device+"&"+query, "token"); code != http.StatusForbidden {
+			t.Errorf("expected status 403 for device %s but got %d", device, code)
+		}
+	}
+	if code := send("id=alice&"+query, ""); code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without authentication but got %d", code)
+	}
+	if len(store.waypoints) != 2 {
+		t.Errorf("expected no further waypoints to be stored but got %d", len(store.waypoints))
+	}
+
+	// implausible waypoints are kept as dead letters
+	if code := send("id=alice&lat=0&lon=0", "token"); code != http.StatusOK {
+		t.Errorf("expected status 200 for a rejected waypoint but got %d", code)
+	}
+	if len(store.deadLetters) != 1 || store.deadLetters[0].Topic != "owntracks/osmand/alice" {
+		t.Errorf("expected the rejected waypoint as dead letter but got %v", store.deadLetters)
+	}
+}
@@ -0,0 +1,230 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/metrics"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// liveBufferSize is the number of waypoints buffered for each live client. Clients falling further behind are
+	// disconnected so they never block receiving messages.
+	liveBufferSize = 100
+	// keepAliveInterval is the time after which an idle live connection is pinged so proxies do not close it
+	keepAliveInterval = 30 * time.Second
+	// liveWriteTimeout is the time a live client has to accept a message
+	liveWriteTimeout = 10 * time.Second
+)
+
+// hub distributes received waypoints to all clients subscribed to their topic
+type hub struct {
+	lock          sync.Mutex
+	subscriptions map[*subscription]bool
+}
+
+// subscription receives the waypoints of topics matching any of its topic filters. The channel is closed if the
+// subscriber is too slow or the hub is closed.
+type subscription struct {
+	filters   []string
+	waypoints chan locationhistory.Waypoint
+}
+
+func newHub() *hub {
+	return &hub{subscriptions: make(map[*subscription]bool)}
+}
+
+// subscribe returns a subscription for all topics matching any of the given MQTT topic filters
+func (h *hub) subscribe(filters []string) *subscription {
+	s := &subscription{filters: filters, waypoints: make(chan locationhistory.Waypoint, liveBufferSize)}
+	h.lock.Lock()
+	h.subscriptions[s] = true
+	h.lock.Unlock()
+	return s
+}
+
+// unsubscribe stops sending waypoints to the given subscription
+func (h *hub) unsubscribe(s *subscription) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.subscriptions[s] {
+		delete(h.subscriptions, s)
+		close(s.waypoints)
+	}
+}
+
+// publish sends the given waypoint to all matching subscriptions without blocking. Subscriptions whose buffer is full
+// are closed.
+func (h *hub) publish(waypoint locationhistory.Waypoint) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for s := range h.subscriptions {
+		if !s.matches(waypoint.Topic) {
+			continue
+		}
+		select {
+		case s.waypoints <- waypoint:
+		default:
+			log.Warnf("Disconnecting live client which is %d waypoints behind", len(s.waypoints))
+			metrics.LiveClientsDropped.Inc()
+			delete(h.subscriptions, s)
+			close(s.waypoints)
+		}
+	}
+}
+
+// close closes all subscriptions so the streams of all clients end
+func (h *hub) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for s := range h.subscriptions {
+		delete(h.subscriptions, s)
+		close(s.waypoints)
+	}
+}
+
+func (s *subscription) matches(topic string) bool {
+	return matchesAnyFilter(s.filters, topic)
+}
+
+// upgrader accepts WebSocket connections from pages of the same origin only
+var upgrader = websocket.Upgrader{}
+
+// handleLive streams the waypoints received for topics matching the topic parameters, which may be given multiple
+// times and contain MQTT wildcards, to WebSocket clients or otherwise as Server-Sent Events. Without topic parameter,
+// all topics are streamed. Only topics readable by the authenticated user are sent.
+func handleLive(h *hub, auth *authenticator) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			http.Error(writer, "Only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		filters := request.URL.Query()["topic"]
+		if len(filters) == 0 {
+			filters = []string{"#"}
+		}
+		for _, filter := range filters {
+			if filter == "" {
+				http.Error(writer, "topic must not be empty", http.StatusBadRequest)
+				return
+			}
+		}
+		readable := func(waypoint locationhistory.Waypoint) bool {
+			return auth.mayRead(request, waypoint.Topic)
+		}
+		if websocket.IsWebSocketUpgrade(request) {
+			streamWebSocket(h.subscribe(filters), h, readable, writer, request)
+			return
+		}
+		streamEvents(h.subscribe(filters), h, readable, writer, request)
+	}
+}
+
+// streamEvents sends the waypoints of the subscription as Server-Sent Events until the client disconnects
+func streamEvents(s *subscription, h *hub, readable func(locationhistory.Waypoint) bool, writer http.ResponseWriter,
+	request *http.Request) {
+	defer h.unsubscribe(s)
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	metrics.LiveClients.WithLabelValues("sse").Inc()
+	defer metrics.LiveClients.WithLabelValues("sse").Dec()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	// disables buffering of the stream by nginx
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-request.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(writer, ": keepalive\n\n")
+		case waypoint, ok := <-s.waypoints:
+			if !ok {
+				return
+			}
+			if !readable(waypoint) {
+				continue
+			}
+			var data []byte
+			data, err = json.Marshal(waypoint)
+			if err == nil {
+				_, err = fmt.Fprintf(writer, "event: waypoint\ndata: %s\n\n", data)
+			}
+		}
+		if err != nil {
+			log.Debugf("Closing live stream: %v", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// streamWebSocket sends the waypoints of the subscription as JSON messages via WebSocket until the client disconnects
+func streamWebSocket(s *subscription, h *hub, readable func(locationhistory.Waypoint) bool,
+	writer http.ResponseWriter, request *http.Request) {
+	defer h.unsubscribe(s)
+	conn, err := upgrader.Upgrade(writer, request, nil)
+	if err != nil {
+		// the upgrader already responded with an error
+		log.Debugf("Unable to upgrade to WebSocket: %v", err)
+		return
+	}
+	defer conn.Close()
+	metrics.LiveClients.WithLabelValues("websocket").Inc()
+	defer metrics.LiveClients.WithLabelValues("websocket").Dec()
+
+	// messages from the client are not expected, but reading is required to process control messages and to notice
+	// when the client closes the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-keepAlive.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteTimeout))
+		case waypoint, ok := <-s.waypoints:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(liveWriteTimeout))
+				return
+			}
+			if !readable(waypoint) {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			err = conn.WriteJSON(waypoint)
+		}
+		if err != nil {
+			log.Debugf("Closing live WebSocket: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package rest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/metrics"
+)
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushing to the wrapped writer, which is required for streaming responses
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes taking over the connection to the wrapped writer, which is required for WebSocket connections
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be taken over")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// instrument returns a handler recording the number and duration of requests served by the given router. Requests
+// are labeled with the pattern of the matching route instead of their path, so topics do not end up in labels.
+func instrument(router *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, route := router.Handler(request)
+		if route == "" {
+			route = "none"
+		}
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		began := time.Now()
+		router.ServeHTTP(recorder, request)
+		metrics.HTTPRequestDuration.WithLabelValues(route).Observe(time.Since(began).Seconds())
+		metrics.HTTPRequests.WithLabelValues(route, request.Method, strconv.Itoa(recorder.status)).Inc()
+	})
+}
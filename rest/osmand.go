@@ -0,0 +1,73 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+// osmAndProtocol accepts the OsmAnd protocol used by the Traccar clients, which send the device ID, position and
+// timestamp as query or form parameters
+type osmAndProtocol struct{}
+
+func (osmAndProtocol) Parse(request *http.Request) (map[string][]locationhistory.Waypoint, error) {
+	err := request.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	device := request.FormValue("id")
+	if device == "" {
+		device = request.FormValue("deviceid")
+	}
+	latitude, err := formFloat(request, "lat")
+	if err != nil {
+		return nil, err
+	}
+	longitude, err := formFloat(request, "lon")
+	if err != nil {
+		return nil, err
+	}
+	if latitude == nil || longitude == nil {
+		return nil, errors.New("parameters lat and lon are required")
+	}
+
+	waypoint := locationhistory.Waypoint{
+		Latitude:  *latitude,
+		Longitude: *longitude,
+		Datetime:  time.Now(),
+	}
+	if value := request.FormValue("timestamp"); value != "" {
+		waypoint.Datetime, err = parseTimestamp(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	optional := []struct {
+		name   string
+		factor float64
+		target **int
+	}{
+		{"altitude", 1, &waypoint.Altitude},
+		{"accuracy", 1, &waypoint.Accuracy},
+		// the OsmAnd protocol sends the speed in knots while waypoints store km/h
+		{"speed", 1.852, &waypoint.Velocity},
+		{"bearing", 1, &waypoint.Course},
+		{"batt", 1, &waypoint.Battery},
+	}
+	for _, field := range optional {
+		value, err := formFloat(request, field.name)
+		if err != nil {
+			return nil, err
+		}
+		*field.target = roundedInt(value, field.factor)
+	}
+
+	return map[string][]locationhistory.Waypoint{device: {waypoint}}, nil
+}
+
+func (osmAndProtocol) Respond(writer http.ResponseWriter) {
+	writer.WriteHeader(http.StatusOK)
+}
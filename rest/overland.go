@@ -0,0 +1,79 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+)
+
+// overlandProtocol accepts the GeoJSON batches sent by Overland
+type overlandProtocol struct{}
+
+type overlandBatch struct {
+	Locations []overlandLocation `json:"locations"`
+}
+
+type overlandLocation struct {
+	Geometry struct {
+		Type        string    `json:"type"`
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties struct {
+		Timestamp          time.Time `json:"timestamp"`
+		Altitude           *float64  `json:"altitude"`
+		Speed              *float64  `json:"speed"`
+		Course             *float64  `json:"course"`
+		HorizontalAccuracy *float64  `json:"horizontal_accuracy"`
+		VerticalAccuracy   *float64  `json:"vertical_accuracy"`
+		BatteryLevel       *float64  `json:"battery_level"`
+		Wifi               string    `json:"wifi"`
+		DeviceID           string    `json:"device_id"`
+	} `json:"properties"`
+}
+
+func (overlandProtocol) Parse(request *http.Request) (map[string][]locationhistory.Waypoint, error) {
+	var batch overlandBatch
+	err := json.NewDecoder(request.Body).Decode(&batch)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[string][]locationhistory.Waypoint)
+	for i, location := range batch.Locations {
+		if location.Geometry.Type != "Point" || len(location.Geometry.Coordinates) < 2 {
+			return nil, fmt.Errorf("location %d is not a point", i)
+		}
+		properties := location.Properties
+		waypoint := locationhistory.Waypoint{
+			// GeoJSON positions are longitude first
+			Longitude:        location.Geometry.Coordinates[0],
+			Latitude:         location.Geometry.Coordinates[1],
+			Datetime:         properties.Timestamp,
+			Altitude:         roundedInt(properties.Altitude, 1),
+			Accuracy:         roundedInt(properties.HorizontalAccuracy, 1),
+			VerticalAccuracy: roundedInt(properties.VerticalAccuracy, 1),
+			// Overland sends the speed in m/s while waypoints store km/h
+			Velocity: roundedInt(properties.Speed, 3.6),
+			Course:   roundedInt(properties.Course, 1),
+			// Overland sends the battery level as fraction
+			Battery: roundedInt(properties.BatteryLevel, 100),
+			SSID:    optionalString(properties.Wifi),
+		}
+		// Overland reports unknown values as -1
+		for _, value := range []**int{&waypoint.Velocity, &waypoint.Course, &waypoint.Battery} {
+			if *value != nil && **value < 0 {
+				*value = nil
+			}
+		}
+		devices[properties.DeviceID] = append(devices[properties.DeviceID], waypoint)
+	}
+	return devices, nil
+}
+
+func (overlandProtocol) Respond(writer http.ResponseWriter) {
+	writer.Header().Set("Content-Type", "application/json")
+	_, _ = writer.Write([]byte(`{"result":"ok"}`))
+}
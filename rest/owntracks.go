@@ -0,0 +1,111 @@
+package rest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/owntracks"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxPayloadSize limits the size of request bodies accepted from devices
+const maxPayloadSize = 1 << 20
+
+// handleOwnTracksPublish returns the handler accepting messages from OwnTracks clients in HTTP mode. The messages are
+// processed by the given router just as messages received via MQTT. The response contains the latest locations and
+// the cards of all other topics the user may read so the clients are able to show their friends.
+func handleOwnTracksPublish(config *configuration.Configuration, ldb locationhistory.Store, router *owntracks.Router,
+	auth *authenticator) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			http.Error(writer, "Only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		topic := ownTracksTopic(config.Ingest.GetTopicPrefix(), request)
+		if topic == "" {
+			http.Error(writer, "Unable to determine user, provide X-Limit-U header", http.StatusBadRequest)
+			return
+		}
+
+		payload, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxPayloadSize))
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Debugf("Got HTTP message for topic '%s': %s", topic, payload)
+
+		err = router.HandleMessage(owntracks.SourceHTTP, topic, payload)
+		if err != nil {
+			if _, rejected := err.(*owntracks.RejectionError); !rejected {
+				log.Errorf("Unable to handle HTTP message for topic '%s': %v", topic, err)
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// rejected messages are kept as dead letters, the client must not send them again
+			log.Warnf("Rejected HTTP message for topic '%s': %v", topic, err)
+		}
+
+		friends, err := ownTracksFriends(ldb, topic, func(topic string) bool {
+			return auth.mayRead(request, topic)
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(writer).Encode(friends)
+		if err != nil {
+			log.Errorf("Unable to write HTTP response: %v", err)
+		}
+	}
+}
+
+// ownTracksTopic builds the topic for a request of an OwnTracks client from the authenticated user and the device
+// taken from the header set by OwnTracks, so users are only able to publish to their own topics. Only if
+// authentication is disabled, the user is taken from the header set by OwnTracks as well.
+func ownTracksTopic(prefix string, request *http.Request) string {
+	user, ok := authenticatedUser(request)
+	if !ok {
+		user = request.Header.Get("X-Limit-U")
+	}
+	if user == "" {
+		return ""
+	}
+	topic := prefix + "/" + user
+	if device := request.Header.Get("X-Limit-D"); device != "" {
+		topic += "/" + device
+	}
+	return topic
+}
+
+// ownTracksFriends returns the cards and latest locations of all topics but the given one for which mayRead returns
+// true
+func ownTracksFriends(ldb locationhistory.Store, topic string, mayRead func(string) bool) ([]interface{}, error) {
+	friends := make([]interface{}, 0)
+
+	cards, err := ldb.GetCards()
+	if err != nil {
+		return nil, err
+	}
+	for _, card := range cards {
+		if card.Topic != topic && mayRead(card.Topic) {
+			friends = append(friends, owntracks.NewCardMessage(card))
+		}
+	}
+
+	waypoints, err := ldb.GetLatestWaypoints()
+	if err != nil {
+		return nil, err
+	}
+	for _, waypoint := range waypoints {
+		if waypoint.Topic != topic && mayRead(waypoint.Topic) {
+			friends = append(friends, owntracks.NewLocationMessage(waypoint))
+		}
+	}
+
+	return friends, nil
+}
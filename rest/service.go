@@ -1,32 +1,83 @@
 package rest
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/dfleischhacker/locationhistory-collector/configuration"
 	locationhistory "github.com/dfleischhacker/locationhistory-collector/locationdb"
+	"github.com/dfleischhacker/locationhistory-collector/owntracks"
 	"github.com/dfleischhacker/locationhistory-collector/rest/static"
+	"github.com/dfleischhacker/locationhistory-collector/utils"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
 // LocationHistoryService provides the data structures for the history service
 type LocationHistoryService struct {
-	ldb *locationhistory.LocationDatabase
+	ldb locationhistory.Store
 }
 
-// NewRestService returns a new REST service using the given config and location database
-func NewRestService(config *configuration.Configuration, ldb *locationhistory.LocationDatabase) {
+// NewRestService returns the server of the REST service using the given config and location database. Messages
+// received from devices via HTTP are processed by the given message router. The given checks have to pass in addition
+// to the database and message age checks for the service to report readiness. The server is not started yet.
+func NewRestService(config *configuration.Configuration, ldb locationhistory.Store, messageRouter *owntracks.Router,
+	checks []HealthCheck) (*http.Server, error) {
+	err := config.Map.Validate()
+	if err != nil {
+		return nil, err
+	}
+	err = config.Auth.Validate()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(config.Map)
+	if err != nil {
+		return nil, err
+	}
 	router := http.NewServeMux()
 
-	router.HandleFunc("/locations/", func(writer http.ResponseWriter, request *http.Request) {
+	// everything except the health and readiness endpoints requires authentication if it is enabled
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		return nil, err
+	}
+	if !config.AuthEnabled() {
+		log.Warn("Authentication is disabled, the location history of all topics is readable and writable by anyone")
+	}
+
+	if config.Ingest.OwnTracks {
+		path := config.Ingest.GetOwnTracksPath()
+		log.Infof("Accepting OwnTracks messages via HTTP on %s", path)
+		router.Handle(path, auth.require(handleOwnTracksPublish(config, ldb, messageRouter, auth)))
+	}
+	for _, endpoint := range config.Ingest.Endpoints {
+		handler, err := handleIngest(config, endpoint, messageRouter, auth)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Accepting %s data via HTTP on %s", endpoint.Protocol, endpoint.Path)
+		router.Handle(endpoint.Path, auth.require(handler))
+	}
+
+	router.Handle("/locations/", auth.require(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		topic := request.URL.Path[11:]
+		if !auth.mayRead(request, topic) {
+			http.Error(writer, "Access to topic denied", http.StatusForbidden)
+			return
+		}
 		log.Infof("Retrieving data for topic '%s'", topic)
-		startTime := time.Date(2015, time.January, 1, 0, 0, 0, 0, time.Local)
-		endTime := time.Date(2020, time.August, 27, 0, 0, 0, 0, time.Local)
-		maxCount := 1000000
-		waypoints, err := ldb.GetWaypoints(topic, &startTime, &endTime, &maxCount)
+		query, err := parseLocationsParams(request)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.Topics = []string{topic}
+		waypoints, err := ldb.QueryWaypoints(query)
 		if err != nil {
 			http.Error(writer, err.Error(), http.StatusInternalServerError)
 			return
@@ -38,35 +89,97 @@ func NewRestService(config *configuration.Configuration, ldb *locationhistory.Lo
 			http.Error(writer, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		writer.Header().Set("Content-Type", "application/gpx+xml")
 		_, err = writer.Write(bytes)
 		if err != nil {
 			http.Error(writer, err.Error(), http.StatusInternalServerError)
 			return
 		}
-	})
-
-	router.Handle("/", http.FileServer(static.AssetFile()))
+	})))
 
-	/*router.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
-		log.Info("Got request for /")
-		_, err := writer.Write(GetIndexFile())
+	router.Handle("/api/v1/topics", auth.require(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		allTopics, err := ldb.GetTopics()
 		if err != nil {
 			http.Error(writer, err.Error(), http.StatusInternalServerError)
 			return
 		}
-	})*/
+		topics := make([]string, 0, len(allTopics))
+		for _, topic := range allTopics {
+			if auth.mayRead(request, topic) {
+				topics = append(topics, topic)
+			}
+		}
+		sort.Strings(topics)
+		writer.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(writer).Encode(topics)
+		if err != nil {
+			log.Errorf("Unable to write topics: %v", err)
+		}
+	})))
+	router.Handle("/api/v1/topics/", auth.require(handleTopicsAPI(ldb, auth)))
+	router.Handle("/api/v1/latest", auth.require(handleLatest(ldb, auth)))
 
-	router.HandleFunc("/token", func(writer http.ResponseWriter, request *http.Request) {
+	live := newHub()
+	messageRouter.AddListener(live.publish)
+	router.Handle("/api/v1/live", auth.require(handleLive(live, auth)))
+
+	router.Handle("/metrics", auth.require(promhttp.Handler()))
+	router.HandleFunc("/healthz", handleHealth)
+	router.HandleFunc("/readyz", handleReady(config, ldb, messageRouter, checks))
+
+	router.Handle("/", auth.require(http.FileServer(static.AssetFile())))
+
+	router.Handle("/token", auth.require(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		log.Info("Got token request")
 		_, err := writer.Write(GetMapboxToken(config.Map.Token))
 		if err != nil {
 			http.Error(writer, err.Error(), http.StatusInternalServerError)
 			return
 		}
-	})
+	})))
 
-	log.Infof("Starting up server on port %d", config.Map.Port)
-	log.Fatal(http.ListenAndServe(config.Map.BindAddress+":"+strconv.Itoa(config.Map.Port), router))
+	server := &http.Server{
+		Addr:      config.Map.BindAddress + ":" + strconv.Itoa(config.Map.Port),
+		Handler:   instrument(router),
+		TLSConfig: tlsConfig,
+	}
+	// live streams never end on their own, so they have to be closed for the server to shut down
+	server.RegisterOnShutdown(live.close)
+	return server, nil
+}
+
+// parseLocationsParams returns the query for the time range, bounding box and maximum number of waypoints requested
+// by the parameters from, to, bbox and limit. Without parameters, the waypoints of the last 24 hours are requested.
+func parseLocationsParams(request *http.Request) (locationhistory.WaypointQuery, error) {
+	params := request.URL.Query()
+	query := locationhistory.WaypointQuery{To: time.Now(), Limit: 1000000}
+	query.From = query.To.Add(-24 * time.Hour)
+	var err error
+	if from := params.Get("from"); from != "" {
+		query.From, err = utils.ParseTime(from)
+		if err != nil {
+			return query, err
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		query.To, err = utils.ParseTime(to)
+		if err != nil {
+			return query, err
+		}
+	}
+	if bbox := params.Get("bbox"); bbox != "" {
+		query.BBox, err = parseBoundingBox(bbox)
+		if err != nil {
+			return query, err
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 {
+			return query, fmt.Errorf("limit must be a positive number")
+		}
+	}
+	return query, nil
 }
 
 // GetMapboxToken returns the mapbox token
@@ -0,0 +1,15 @@
+// Package static contains the files of the web UI, which are embedded into the binary
+package static
+
+import (
+	"embed"
+	"net/http"
+)
+
+//go:embed index.html
+var files embed.FS
+
+// AssetFile returns a file system serving the embedded files of the web UI
+func AssetFile() http.FileSystem {
+	return http.FS(files)
+}
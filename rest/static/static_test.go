@@ -0,0 +1,22 @@
+package static
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestIndexEmbedded(t *testing.T) {
+	file, err := AssetFile().Open("/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "<html") {
+		t.Error("expected the embedded index.html")
+	}
+}
@@ -0,0 +1,147 @@
+package rest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dfleischhacker/locationhistory-collector/configuration"
+	log "github.com/sirupsen/logrus"
+)
+
+// certificateReloader provides the server certificate during TLS handshakes and loads it again whenever the
+// certificate or key file changes, so renewed certificates are used without restarting the collector
+type certificateReloader struct {
+	certFile    string
+	keyFile     string
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	modified    time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	reloader := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	modified, err := reloader.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	err = reloader.load(modified)
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// lastModified returns the time either the certificate or the key file was modified last
+func (r *certificateReloader) lastModified() (time.Time, error) {
+	var modified time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modified, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+func (r *certificateReloader) load(modified time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load server certificate: %v", err)
+	}
+	r.certificate = &certificate
+	r.modified = modified
+	return nil
+}
+
+// GetCertificate returns the current certificate. If the files changed but cannot be loaded, e.g. because only one
+// of them has been replaced yet, the previous certificate is used.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	modified, err := r.lastModified()
+	if err != nil {
+		log.Warnf("Unable to check server certificate for changes: %v", err)
+	} else if modified.After(r.modified) {
+		err = r.load(modified)
+		if err != nil {
+			log.Warnf("Using previous server certificate: %v", err)
+		} else {
+			log.Infof("Loaded changed server certificate from %s", r.certFile)
+		}
+	}
+	return r.certificate, nil
+}
+
+// newTLSConfig returns the TLS configuration of the web server or nil if HTTPS is not enabled
+func newTLSConfig(config configuration.MapConfig) (*tls.Config, error) {
+	if !config.TLSEnabled() {
+		return nil, nil
+	}
+	minVersion, err := config.GetMinTLSVersion()
+	if err != nil {
+		return nil, err
+	}
+	reloader, err := newCertificateReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		// clients without certificate, e.g. health checks or tracking apps, are authenticated by other means
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// NewRedirectServer returns a server redirecting all requests to the HTTPS server configured by the given config or
+// nil if no redirect is configured. The server is not started yet.
+func NewRedirectServer(config configuration.MapConfig) *http.Server {
+	if !config.TLSEnabled() || config.RedirectPort == 0 {
+		return nil
+	}
+	return &http.Server{
+		Addr: config.BindAddress + ":" + strconv.Itoa(config.RedirectPort),
+		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			host := request.Host
+			if name, _, err := net.SplitHostPort(host); err == nil {
+				host = name
+			}
+			if config.Port != 443 {
+				host = net.JoinHostPort(host, strconv.Itoa(config.Port))
+			}
+			http.Redirect(writer, request, "https://"+host+request.URL.RequestURI(), http.StatusMovedPermanently)
+		}),
+	}
+}
+
+// ListenAndServe starts the given server and serves HTTPS if the server has a TLS configuration
+func ListenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		// the certificate is provided by the TLS configuration
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeLayouts are the layouts accepted by ParseTime, layouts without timezone are interpreted as local time
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// relativeTimePattern matches relative times like -7d or 12h
+var relativeTimePattern = regexp.MustCompile(`^([+-]?)(\d+)\s*(s|m|h|d|w)$`)
+
+var relativeTimeUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// ParseTime parses the given value as absolute date or date and time, as time relative to now (e.g. -7d, -12h or
+// -30m) or as one of the natural expressions now, today, yesterday, last week and last month. The natural expressions
+// except now refer to the start of the respective day.
+func ParseTime(value string) (time.Time, error) {
+	return parseTimeAt(value, time.Now())
+}
+
+func parseTimeAt(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch strings.ToLower(value) {
+	case "now":
+		return now, nil
+	case "today":
+		return today, nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), nil
+	case "last week":
+		return today.AddDate(0, 0, -7), nil
+	case "last month":
+		return today.AddDate(0, -1, 0), nil
+	}
+
+	if match := relativeTimePattern.FindStringSubmatch(value); match != nil {
+		amount, err := strconv.Atoi(match[2])
+		if err == nil {
+			offset := time.Duration(amount) * relativeTimeUnits[match[3]]
+			if match[1] == "-" {
+				offset = -offset
+			}
+			return now.Add(offset), nil
+		}
+	}
+
+	for _, layout := range timeLayouts {
+		t, err := time.ParseInLocation(layout, value, now.Location())
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to parse time '%s', use e.g. 2006-01-02, 2006-01-02T15:04:05Z, -7d or yesterday", value)
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeAt(t *testing.T) {
+	zone := time.FixedZone("CEST", 2*60*60)
+	now := time.Date(2020, time.August, 15, 14, 30, 0, 0, zone)
+	today := time.Date(2020, time.August, 15, 0, 0, 0, 0, zone)
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"now", now},
+		{" Today ", today},
+		{"yesterday", today.AddDate(0, 0, -1)},
+		{"last week", today.AddDate(0, 0, -7)},
+		{"last month", time.Date(2020, time.July, 15, 0, 0, 0, 0, zone)},
+		{"-7d", now.Add(-7 * 24 * time.Hour)},
+		{"12h", now.Add(12 * time.Hour)},
+		{"+30m", now.Add(30 * time.Minute)},
+		{"-2w", now.Add(-14 * 24 * time.Hour)},
+		{"2020-08-01", time.Date(2020, time.August, 1, 0, 0, 0, 0, zone)},
+		{"2020-08-01 12:15", time.Date(2020, time.August, 1, 12, 15, 0, 0, zone)},
+		{"2020-08-01T12:15:30", time.Date(2020, time.August, 1, 12, 15, 30, 0, zone)},
+	}
+	for _, test := range tests {
+		parsed, err := parseTimeAt(test.value, now)
+		if err != nil {
+			t.Errorf("unable to parse '%s': %v", test.value, err)
+			continue
+		}
+		if !parsed.Equal(test.expected) {
+			t.Errorf("expected %v for '%s' but got %v", test.expected, test.value, parsed)
+		}
+		if parsed.Location() != zone {
+			t.Errorf("expected '%s' in the location of now but got %v", test.value, parsed.Location())
+		}
+	}
+
+	// the offset of times including one is kept
+	parsed, err := parseTimeAt("2020-08-01T12:15:30Z", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(time.Date(2020, time.August, 1, 12, 15, 30, 0, time.UTC)) || parsed.Location() != time.UTC {
+		t.Errorf("expected the time in UTC but got %v", parsed)
+	}
+
+	for _, invalid := range []string{"", "tomorrow", "-7y", "2020-13-01"} {
+		if _, err := parseTimeAt(invalid, now); err == nil {
+			t.Errorf("expected an error for '%s'", invalid)
+		}
+	}
+}
@@ -24,6 +24,11 @@ func (unixtime *UnixTime) UnmarshalJSON(data []byte) (err error) {
 	return
 }
 
+// MarshalJSON writes the UnixTime as unix timestamp
+func (unixtime UnixTime) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatInt(unixtime.Unix(), 10)), nil
+}
+
 // GetUnixTime parses the given string into a UnixTime.
 // Before the actual conversion, the input value is divided by the given factor. This allows to convert timestamps
 // which are based on milliseconds instead of seconds.